@@ -12,3 +12,12 @@ Create chart name and version as used by the chart label.
 {{- define "webhook-instrumentor.chart" -}}
 {{- printf "%s-%s" .Chart.Name .Chart.Version | replace "+" "_" | trunc 63 | trimSuffix "-" -}}
 {{- end -}}
+
+{{/*
+Webhook manages its own serving certificate, unless OpenShift service CA is used.
+*/}}
+{{- define "webhook-instrumentor.selfManagedCerts" -}}
+{{- if and .Values.selfManagedCerts (not ( and ( .Values.useServiceCAonOCP ) ( .Capabilities.APIVersions.Has "apps.openshift.io/v1/DeploymentConfig") )) -}}
+true
+{{- end -}}
+{{- end -}}
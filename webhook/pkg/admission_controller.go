@@ -24,7 +24,8 @@ import (
 	"log"
 	"net/http"
 
-	admission "k8s.io/api/admission/v1beta1"
+	admission "k8s.io/api/admission/v1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
@@ -36,8 +37,18 @@ const (
 
 var (
 	universalDeserializer = serializer.NewCodecFactory(runtime.NewScheme()).UniversalDeserializer()
+
+	// admissionDeserializer knows both admission.k8s.io/v1 and admission.k8s.io/v1beta1 AdmissionReview
+	// types, so the decoded object carries the API version the API server actually sent.
+	admissionScheme       = runtime.NewScheme()
+	admissionDeserializer = serializer.NewCodecFactory(admissionScheme).UniversalDeserializer()
 )
 
+func init() {
+	admission.AddToScheme(admissionScheme)
+	admissionv1beta1.AddToScheme(admissionScheme)
+}
+
 // patchOperation is an operation of a JSON patch, see https://tools.ietf.org/html/rfc6902 .
 type patchOperation struct {
 	Op    string      `json:"op"`
@@ -47,13 +58,29 @@ type patchOperation struct {
 
 // admitFunc is a callback for admission controller logic. Given an AdmissionRequest, it returns the sequence of patch
 // operations to be applied in case of success, or the error that will be shown when the operation is rejected.
-type admitFunc func(*admission.AdmissionRequest) ([]patchOperation, error)
+// The AdmissionResponse being built is passed in as well, so the callback can attach warnings and audit annotations.
+// Requests and responses are always admission.k8s.io/v1 types, v1beta1 reviews are converted on the way in and out.
+type admitFunc func(*admission.AdmissionRequest, *admission.AdmissionResponse) ([]patchOperation, error)
 
 // isKubeNamespace checks if the given namespace is a Kubernetes-owned namespace.
 func isKubeNamespace(ns string) bool {
 	return ns == metav1.NamespacePublic || ns == metav1.NamespaceSystem
 }
 
+// addAuditAnnotation records a key/value pair in the audit event of the admission request. The API server prefixes
+// the key with the name of the webhook.
+func addAuditAnnotation(resp *admission.AdmissionResponse, key string, value string) {
+	if resp.AuditAnnotations == nil {
+		resp.AuditAnnotations = map[string]string{}
+	}
+	resp.AuditAnnotations[key] = value
+}
+
+// addWarning adds a warning returned to the requesting API client, e.g. shown by kubectl.
+func addWarning(resp *admission.AdmissionResponse, format string, args ...any) {
+	resp.Warnings = append(resp.Warnings, fmt.Sprintf(format, args...))
+}
+
 // doServeAdmitFunc parses the HTTP request for an admission controller webhook, and -- in case of a well-formed
 // request -- delegates the admission control logic to the given admitFunc. The response body is then returned as raw
 // bytes.
@@ -76,40 +103,43 @@ func doServeAdmitFunc(w http.ResponseWriter, r *http.Request, admit admitFunc) (
 		return nil, fmt.Errorf("unsupported content type %s, only %s is supported", contentType, jsonContentType)
 	}
 
-	// Step 2: Parse the AdmissionReview request.
-
-	var admissionReviewReq admission.AdmissionReview
+	// Step 2: Parse the AdmissionReview request. Both v1 and v1beta1 are accepted, v1beta1 is converted to v1 so the
+	// admission logic only ever deals with one set of types.
 
-	if _, _, err := universalDeserializer.Decode(body, nil, &admissionReviewReq); err != nil {
+	obj, gvk, err := admissionDeserializer.Decode(body, nil, nil)
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return nil, fmt.Errorf("could not deserialize request: %v", err)
-	} else if admissionReviewReq.Request == nil {
+	}
+
+	var admissionReq *admission.AdmissionRequest
+	switch review := obj.(type) {
+	case *admission.AdmissionReview:
+		admissionReq = review.Request
+	case *admissionv1beta1.AdmissionReview:
+		admissionReq = admissionRequestFromV1beta1(review.Request)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, fmt.Errorf("unsupported admission review type %v", gvk)
+	}
+	if admissionReq == nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return nil, errors.New("malformed admission review: request is nil")
 	}
 
-	fmt.Printf("Admission Request For: %v\n", admissionReviewReq.Request.Name)
+	fmt.Printf("Admission Request For: %v (%s)\n", admissionReq.Name, gvk.GroupVersion())
 
 	// Step 3: Construct the AdmissionReview response.
 
-	admissionReviewResponse := admission.AdmissionReview{
-		// Since the admission webhook now supports multiple API versions, we need
-		// to explicitly include the API version in the response.
-		// This API version needs to match the version from the request exactly, otherwise
-		// the API server will be unable to process the response.
-		// Note: a v1beta1 AdmissionReview is JSON-compatible with the v1 version, that's why
-		// we do not need to differentiate during unmarshaling or in the actual logic.
-		TypeMeta: admissionReviewReq.TypeMeta,
-		Response: &admission.AdmissionResponse{
-			UID: admissionReviewReq.Request.UID,
-		},
+	admissionResponse := &admission.AdmissionResponse{
+		UID: admissionReq.UID,
 	}
 
 	var patchOps []patchOperation
 	// Apply the admit() function only for non-Kubernetes namespaces. For objects in Kubernetes namespaces, return
 	// an empty set of patch operations.
-	if !isKubeNamespace(admissionReviewReq.Request.Namespace) {
-		patchOps, err = admit(admissionReviewReq.Request)
+	if !isKubeNamespace(admissionReq.Namespace) {
+		patchOps, err = admit(admissionReq, admissionResponse)
 	}
 
 	fmt.Printf("Patch Ops: %v\n", patchOps)
@@ -117,8 +147,8 @@ func doServeAdmitFunc(w http.ResponseWriter, r *http.Request, admit admitFunc) (
 	if err != nil {
 		// If the handler returned an error, incorporate the error message into the response and deny the object
 		// creation.
-		admissionReviewResponse.Response.Allowed = false
-		admissionReviewResponse.Response.Result = &metav1.Status{
+		admissionResponse.Allowed = false
+		admissionResponse.Result = &metav1.Status{
 			Message: err.Error(),
 		}
 	} else {
@@ -128,19 +158,35 @@ func doServeAdmitFunc(w http.ResponseWriter, r *http.Request, admit admitFunc) (
 			w.WriteHeader(http.StatusInternalServerError)
 			return nil, fmt.Errorf("could not marshal JSON patch: %v", err)
 		}
-		admissionReviewResponse.Response.Allowed = true
-		admissionReviewResponse.Response.Patch = patchBytes
+		admissionResponse.Allowed = true
+		admissionResponse.Patch = patchBytes
 		otelAddAttrs(r.Context(), body, patchBytes)
 
 		// Announce that we are returning a JSON patch (note: this is the only
 		// patch type currently supported, but we have to explicitly announce
 		// it nonetheless).
-		admissionReviewResponse.Response.PatchType = new(admission.PatchType)
-		*admissionReviewResponse.Response.PatchType = admission.PatchTypeJSONPatch
+		admissionResponse.PatchType = new(admission.PatchType)
+		*admissionResponse.PatchType = admission.PatchTypeJSONPatch
+	}
+
+	// The response API version needs to match the version from the request exactly, otherwise
+	// the API server will be unable to process the response.
+	var admissionReviewResponse runtime.Object
+	switch obj.(type) {
+	case *admissionv1beta1.AdmissionReview:
+		admissionReviewResponse = &admissionv1beta1.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{APIVersion: gvk.GroupVersion().String(), Kind: gvk.Kind},
+			Response: admissionResponseToV1beta1(admissionResponse),
+		}
+	default:
+		admissionReviewResponse = &admission.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{APIVersion: gvk.GroupVersion().String(), Kind: gvk.Kind},
+			Response: admissionResponse,
+		}
 	}
 
 	// Return the AdmissionReview with a response as JSON.
-	bytes, err := json.Marshal(&admissionReviewResponse)
+	bytes, err := json.Marshal(admissionReviewResponse)
 	if err != nil {
 		return nil, fmt.Errorf("marshaling response: %v", err)
 	}
@@ -150,6 +196,48 @@ func doServeAdmitFunc(w http.ResponseWriter, r *http.Request, admit admitFunc) (
 	return bytes, nil
 }
 
+// admissionRequestFromV1beta1 converts a v1beta1 AdmissionRequest to its v1 counterpart. Both versions carry the
+// same fields, only some enumeration types differ.
+func admissionRequestFromV1beta1(req *admissionv1beta1.AdmissionRequest) *admission.AdmissionRequest {
+	if req == nil {
+		return nil
+	}
+	return &admission.AdmissionRequest{
+		UID:                req.UID,
+		Kind:               req.Kind,
+		Resource:           req.Resource,
+		SubResource:        req.SubResource,
+		RequestKind:        req.RequestKind,
+		RequestResource:    req.RequestResource,
+		RequestSubResource: req.RequestSubResource,
+		Name:               req.Name,
+		Namespace:          req.Namespace,
+		Operation:          admission.Operation(req.Operation),
+		UserInfo:           req.UserInfo,
+		Object:             req.Object,
+		OldObject:          req.OldObject,
+		DryRun:             req.DryRun,
+		Options:            req.Options,
+	}
+}
+
+// admissionResponseToV1beta1 converts a v1 AdmissionResponse back to v1beta1 for API servers sending v1beta1 reviews.
+func admissionResponseToV1beta1(resp *admission.AdmissionResponse) *admissionv1beta1.AdmissionResponse {
+	v1beta1Resp := &admissionv1beta1.AdmissionResponse{
+		UID:              resp.UID,
+		Allowed:          resp.Allowed,
+		Result:           resp.Result,
+		Patch:            resp.Patch,
+		AuditAnnotations: resp.AuditAnnotations,
+		Warnings:         resp.Warnings,
+	}
+	if resp.PatchType != nil {
+		patchType := admissionv1beta1.PatchType(*resp.PatchType)
+		v1beta1Resp.PatchType = &patchType
+	}
+	return v1beta1Resp
+}
+
 // serveAdmitFunc is a wrapper around doServeAdmitFunc that adds error handling and logging.
 func serveAdmitFunc(w http.ResponseWriter, r *http.Request, admit admitFunc) {
 	// log.Print("Handling webhook request ...")
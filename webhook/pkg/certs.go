@@ -0,0 +1,401 @@
+/*
+Copyright (c) 2019 Cisco Systems, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/certwatcher"
+	configK8s "sigs.k8s.io/controller-runtime/pkg/client/config"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	tlsCAFile    = `ca.crt`
+	tlsCAKeyFile = `ca.key`
+
+	CA_VALIDITY          = 10 * 365 * 24 * time.Hour
+	CERT_CHECK_INTERVAL  = 10 * time.Minute
+	CERT_RETRY_INTERVAL  = 5 * time.Second
+	CERT_RENEW_REMAINING = 3 // renew when less than 1/CERT_RENEW_REMAINING of the validity is left
+)
+
+type CertConfig struct {
+	SelfManaged  bool   // When false, certificates are read from tlsDir, e.g. provided by Helm or OpenShift service CA
+	Namespace    string // Namespace of the webhook service and of the certificate secret
+	SecretName   string // Secret holding CA and serving certificate
+	ServiceName  string // Service the API server calls the webhook by
+	WebhookName  string // Name of MutatingWebhookConfiguration, ValidatingWebhookConfiguration is suffixed -validate
+	ValidityDays int    // Validity of the serving certificate
+}
+
+// initServingCertificates returns TLS configuration with the serving certificate either watched on
+// the file system, or created, rotated and stored in a secret by the webhook itself
+func initServingCertificates(ctx context.Context, certConfig CertConfig) (*tls.Config, error) {
+	if !certConfig.SelfManaged {
+		// the files get replaced in place when the mounted secret changes, e.g. on OpenShift service CA rotation
+		watcher, err := certwatcher.New(filepath.Join(tlsDir, tlsCertFile), filepath.Join(tlsDir, tlsKeyFile))
+		if err != nil {
+			return nil, fmt.Errorf("cannot read certificates from %s: %v", tlsDir, err)
+		}
+		go func() {
+			if err := watcher.Start(ctx); err != nil {
+				log.Log.Error(err, "Certificate watcher stopped")
+			}
+		}()
+		return &tls.Config{GetCertificate: watcher.GetCertificate}, nil
+	}
+
+	clientset, err := kubernetes.NewForConfig(configK8s.GetConfigOrDie())
+	if err != nil {
+		return nil, err
+	}
+	provider := &selfManagedCertProvider{certConfig: certConfig, client: clientset}
+
+	// the server cannot start without a certificate, keep trying until the secret can be read or written
+	err = wait.PollUntilContextCancel(ctx, CERT_RETRY_INTERVAL, true, func(ctx context.Context) (bool, error) {
+		if err := provider.ensureCertificate(ctx); err != nil {
+			log.Log.Error(err, "Cannot provision serving certificate, retrying", "secret", certConfig.SecretName)
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	go provider.run(ctx)
+
+	return &tls.Config{GetCertificate: provider.GetCertificate}, nil
+}
+
+type selfManagedCertProvider struct {
+	certConfig CertConfig
+	client     kubernetes.Interface
+	mutex      sync.RWMutex
+	cert       *tls.Certificate
+	certPEM    []byte
+}
+
+func (p *selfManagedCertProvider) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.cert, nil
+}
+
+// run periodically renews certificates close to expiry and picks up certificates rotated by other replicas
+func (p *selfManagedCertProvider) run(ctx context.Context) {
+	ticker := time.NewTicker(CERT_CHECK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := p.ensureCertificate(ctx); err != nil {
+				log.Log.Error(err, "Cannot renew serving certificate", "secret", p.certConfig.SecretName)
+			}
+		}
+	}
+}
+
+// ensureCertificate makes sure the secret holds a valid CA and serving certificate, loads the serving certificate
+// and makes sure the webhook configurations trust the CA
+func (p *selfManagedCertProvider) ensureCertificate(ctx context.Context) error {
+	secrets := p.client.CoreV1().Secrets(p.certConfig.Namespace)
+
+	secret, err := secrets.Get(ctx, p.certConfig.SecretName, metav1.GetOptions{})
+	create := apierrors.IsNotFound(err)
+	if err != nil && !create {
+		return err
+	}
+	if create {
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      p.certConfig.SecretName,
+				Namespace: p.certConfig.Namespace,
+			},
+			Type: corev1.SecretTypeTLS,
+		}
+	}
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+
+	changed, err := p.renewSecretData(secret.Data, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if create {
+		log.Log.Info("Creating serving certificate secret", "namespace", p.certConfig.Namespace, "name", p.certConfig.SecretName)
+		if _, err := secrets.Create(ctx, secret, metav1.CreateOptions{}); err != nil {
+			// another replica may have won the race, its certificate is used on the next round
+			return err
+		}
+	} else if changed {
+		log.Log.Info("Rotating serving certificate", "namespace", p.certConfig.Namespace, "name", p.certConfig.SecretName)
+		if _, err := secrets.Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+	}
+
+	if err := p.loadCertificate(secret.Data); err != nil {
+		return err
+	}
+
+	return p.patchCABundles(ctx, secret.Data[tlsCAFile])
+}
+
+// renewSecretData replaces CA and serving certificate in data when missing or close to expiry. The CA file
+// keeps the previous CA as long as it is valid, so replicas still serving the old certificate stay trusted.
+func (p *selfManagedCertProvider) renewSecretData(data map[string][]byte, now time.Time) (bool, error) {
+	changed := false
+
+	caCert, caKey, err := parseCA(data[tlsCAFile], data[tlsCAKeyFile])
+	if err != nil || needsRenewal(caCert, now) {
+		log.Log.Info("Generating webhook CA", "reason", renewalReason(err))
+		caCertPEM, caKeyPEM, err := generateCA(now)
+		if err != nil {
+			return false, err
+		}
+		if caCert != nil && now.Before(caCert.NotAfter) {
+			caCertPEM = append(caCertPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw})...)
+		}
+		data[tlsCAFile] = caCertPEM
+		data[tlsCAKeyFile] = caKeyPEM
+		if caCert, caKey, err = parseCA(data[tlsCAFile], data[tlsCAKeyFile]); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+
+	dnsNames := p.dnsNames()
+	servingCert, err := parseServingCert(data[tlsCertFile], data[tlsKeyFile])
+	if err == nil && (needsRenewal(servingCert, now) || servingCert.CheckSignatureFrom(caCert) != nil || !slices.Equal(servingCert.DNSNames, dnsNames)) {
+		err = errors.New("serving certificate expiring, not issued by current CA or for a different service")
+	}
+	if err != nil || changed {
+		log.Log.Info("Generating webhook serving certificate", "reason", renewalReason(err), "dnsNames", dnsNames)
+		certPEM, keyPEM, err := generateServingCert(caCert, caKey, dnsNames, now, time.Duration(p.certConfig.ValidityDays)*24*time.Hour)
+		if err != nil {
+			return false, err
+		}
+		data[tlsCertFile] = certPEM
+		data[tlsKeyFile] = keyPEM
+		changed = true
+	}
+
+	return changed, nil
+}
+
+func (p *selfManagedCertProvider) loadCertificate(data map[string][]byte) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if bytes.Equal(p.certPEM, data[tlsCertFile]) {
+		return nil
+	}
+	cert, err := tls.X509KeyPair(data[tlsCertFile], data[tlsKeyFile])
+	if err != nil {
+		return err
+	}
+	log.Log.Info("Loaded serving certificate", "secret", p.certConfig.SecretName)
+	p.cert = &cert
+	p.certPEM = data[tlsCertFile]
+	return nil
+}
+
+// patchCABundles sets the CA bundle of all webhooks calling our service
+func (p *selfManagedCertProvider) patchCABundles(ctx context.Context, caBundle []byte) error {
+	admissionClient := p.client.AdmissionregistrationV1()
+
+	mwhc, err := admissionClient.MutatingWebhookConfigurations().Get(ctx, p.certConfig.WebhookName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	changed := false
+	for idx := range mwhc.Webhooks {
+		if p.isOwnService(mwhc.Webhooks[idx].ClientConfig.Service) && !bytes.Equal(mwhc.Webhooks[idx].ClientConfig.CABundle, caBundle) {
+			mwhc.Webhooks[idx].ClientConfig.CABundle = caBundle
+			changed = true
+		}
+	}
+	if changed {
+		log.Log.Info("Updating CA bundle", "mutatingWebhookConfiguration", mwhc.Name)
+		if _, err := admissionClient.MutatingWebhookConfigurations().Update(ctx, mwhc, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+	}
+
+	vwhc, err := admissionClient.ValidatingWebhookConfigurations().Get(ctx, p.certConfig.WebhookName+"-validate", metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	changed = false
+	for idx := range vwhc.Webhooks {
+		if p.isOwnService(vwhc.Webhooks[idx].ClientConfig.Service) && !bytes.Equal(vwhc.Webhooks[idx].ClientConfig.CABundle, caBundle) {
+			vwhc.Webhooks[idx].ClientConfig.CABundle = caBundle
+			changed = true
+		}
+	}
+	if changed {
+		log.Log.Info("Updating CA bundle", "validatingWebhookConfiguration", vwhc.Name)
+		if _, err := admissionClient.ValidatingWebhookConfigurations().Update(ctx, vwhc, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *selfManagedCertProvider) isOwnService(service *admissionregistrationv1.ServiceReference) bool {
+	return service != nil && service.Name == p.certConfig.ServiceName && service.Namespace == p.certConfig.Namespace
+}
+
+func (p *selfManagedCertProvider) dnsNames() []string {
+	service := p.certConfig.ServiceName
+	namespace := p.certConfig.Namespace
+	return []string{
+		service,
+		service + "." + namespace,
+		service + "." + namespace + ".svc",
+		service + "." + namespace + ".svc.cluster.local",
+	}
+}
+
+func needsRenewal(cert *x509.Certificate, now time.Time) bool {
+	validity := cert.NotAfter.Sub(cert.NotBefore)
+	return cert.NotAfter.Sub(now) < validity/CERT_RENEW_REMAINING
+}
+
+func renewalReason(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return "renewal"
+}
+
+// parseCA returns the first certificate of the CA bundle and its key
+func parseCA(certPEM []byte, keyPEM []byte) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return nil, nil, errors.New("CA certificate missing")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return cert, nil, errors.New("CA key missing")
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return cert, nil, err
+	}
+	return cert, key, nil
+}
+
+func parseServingCert(certPEM []byte, keyPEM []byte) (*x509.Certificate, error) {
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		return nil, err
+	}
+	certBlock, _ := pem.Decode(certPEM)
+	return x509.ParseCertificate(certBlock.Bytes)
+}
+
+func generateCA(now time.Time) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          randomSerialNumber(),
+		Subject:               pkix.Name{CommonName: "webhook-instrumentor-ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(CA_VALIDITY),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return encodeCertAndKey(der, key)
+}
+
+func generateServingCert(ca *x509.Certificate, caKey *ecdsa.PrivateKey, dnsNames []string, now time.Time, validity time.Duration) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: randomSerialNumber(),
+		Subject:      pkix.Name{CommonName: dnsNames[len(dnsNames)-2]},
+		DNSNames:     dnsNames,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return encodeCertAndKey(der, key)
+}
+
+func encodeCertAndKey(der []byte, key *ecdsa.PrivateKey) ([]byte, []byte, error) {
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return certPEM, keyPEM, nil
+}
+
+func randomSerialNumber() *big.Int {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return serial
+}
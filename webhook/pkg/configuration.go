@@ -17,6 +17,7 @@ limitations under the License.
 package main
 
 import (
+	"cmp"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -24,8 +25,9 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
-	"regexp"
 	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"text/template"
 	"time"
@@ -35,6 +37,7 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 	"k8s.io/apimachinery/pkg/util/yaml"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
@@ -49,6 +52,15 @@ const (
 	DEFAULT_CONFIG_MAP_NAME = "webhook-instrumentor-config"
 )
 
+// config map key of the global kill switch, when true no pod gets instrumented by any rule
+const SUSPEND_INSTRUMENTATION_CONFIG_KEY = "suspendInstrumentation"
+
+// priority of rules which do not specify any, same as the CRD default
+const DEFAULT_RULE_PRIORITY = 1
+
+// order of rule sources for rules with equal priority, unless set by ruleSourcePrecedence in the config map
+var defaultRuleSourcePrecedence = []string{RULE_SOURCE_NAMESPACED_CRD, RULE_SOURCE_CLUSTER_CRD, RULE_SOURCE_CONFIGMAP}
+
 var (
 	client      dynamic.Interface
 	clientset   *kubernetes.Clientset
@@ -61,11 +73,14 @@ type Config struct {
 	ControllerConfig              *ControllerConfig
 	AppdCloudConfig               *AppdCloudConfig
 	TelescopeConfig               *TelescopeConfig
-	InstrumentationConfig         *InstrumentationConfig            // This comes from the config map and is configured by Helm chart
-	InstrumentationClusterCrds    *InstrumentationConfig            // This comes from GlobalInstrumentation CRDs
-	InstrumentationNamespacedCrds map[string]*InstrumentationConfig // This comes from Instrumentation CRDs ans is namespace specific
+	InstrumentationConfig         *InstrumentationRules            // This comes from the config map and is configured by Helm chart
+	InstrumentationClusterCrds    *InstrumentationRules            // This comes from GlobalInstrumentation CRDs
+	InstrumentationNamespacedCrds map[string]*InstrumentationRules // This comes from Instrumentation CRDs ans is namespace specific
+	InjectionTemplates            *InjectionTemplates
 	FlexMatchTemplate             *template.Template
-	CrdsDisabled                  bool // When set to true, namespaced Instrumentation is disabled
+	RuleSourcePrecedence          []string // Order of rule sources for rules with equal priority
+	CrdsDisabled                  bool     // When set to true, namespaced Instrumentation is disabled
+	InstrumentationSuspended      bool     // When set to true, no rule applies, see SUSPEND_INSTRUMENTATION_CONFIG_KEY
 	mutex                         sync.Mutex
 }
 
@@ -107,14 +122,16 @@ type groupResource struct {
 }
 
 var config = Config{
-	InstrumentationClusterCrds:    &InstrumentationConfig{},
-	InstrumentationNamespacedCrds: map[string]*InstrumentationConfig{},
+	InstrumentationClusterCrds:    &InstrumentationRules{},
+	InstrumentationNamespacedCrds: map[string]*InstrumentationRules{},
+	RuleSourcePrecedence:          defaultRuleSourcePrecedence,
 }
 
 func runConfigWatcher() {
 
 	initClient()
 
+	startNamespaceWatcher()
 	go configurationWatcher(config.MyNamespace)
 
 	ticker := time.NewTicker(5 * 60 * 1000 * time.Millisecond) // every 5 minutes
@@ -226,6 +243,10 @@ func updateConfig(obj interface{}) {
 
 	data := cm.Data
 
+	// kill switch is applied even if the rest of the configuration is not valid, so that it works
+	// in any situation
+	suspendInstrumentation(data[SUSPEND_INSTRUMENTATION_CONFIG_KEY])
+
 	controller := data["controller"]
 	if controller == "" {
 		log.Printf("Error getting required controller configuration\n")
@@ -264,13 +285,20 @@ func updateConfig(obj interface{}) {
 	}
 	log.Printf("FlexMatch config: \n%s\n", flexMatchConfig)
 
+	ruleSourcePrecedence, err := parseRuleSourcePrecedence(data["ruleSourcePrecedence"])
+	if err != nil {
+		log.Printf("Error parsing rule source precedence: %v\n", err)
+		return
+	}
+	log.Printf("Rule source precedence: %v\n", ruleSourcePrecedence)
+
 	controllerConfig := &ControllerConfig{}
 	instrumentationConfig := &InstrumentationConfig{}
 	injectionTemplates := &InjectionTemplates{}
 	appdCloudConfig := &AppdCloudConfig{}
 	telescopeConfig := &TelescopeConfig{}
 
-	err := yaml.Unmarshal([]byte(controller), controllerConfig)
+	err = yaml.Unmarshal([]byte(controller), controllerConfig)
 	if err != nil {
 		log.Printf("Error parsing required controller configuration: %v\n", err)
 		return
@@ -314,14 +342,24 @@ func updateConfig(obj interface{}) {
 		return
 	}
 
+	instrumentationRules, err := newInstrumentationRules(instrumentationConfig)
+	if err != nil {
+		log.Printf("Error compiling instrumentation rules: %v\n", err)
+		return
+	}
+	// rules from the config map keep their order in the file for equal priorities
+	slices.SortStableFunc(*instrumentationRules, compareRulePriority)
+
 	config.mutex.Lock()
 	defer config.mutex.Unlock()
 	config.ControllerConfig = controllerConfig
-	config.InstrumentationConfig = instrumentationConfig
+	config.InstrumentationConfig = instrumentationRules
+	config.InjectionTemplates = injectionTemplates
 	config.TelescopeConfig = telescopeConfig
 	config.AppdCloudConfig = appdCloudConfig
+	config.RuleSourcePrecedence = ruleSourcePrecedence
 	if flexMatchConfig != "" {
-		config.FlexMatchTemplate, err = template.New("test").Parse(flexMatchConfig)
+		config.FlexMatchTemplate, err = template.New("flexMatch").Parse(flexMatchConfig)
 		if err != nil {
 			log.Printf("Error parsing flex match template %s: %v\n", flexMatchConfig, err)
 			config.FlexMatchTemplate = nil
@@ -455,6 +493,9 @@ func injectionRuleTemplate(injRules *v1alpha1.InjectionRule, injTempRules *v1alp
 		injRules.SplunkConfig.DeploymentEnvironmentNameExpression = applyTemplateString(injRules.SplunkConfig.DeploymentEnvironmentNameExpression, injTempRules.SplunkConfig.DeploymentEnvironmentNameExpression)
 		injRules.SplunkConfig.K8SClusterName = applyTemplateString(injRules.SplunkConfig.K8SClusterName, injTempRules.SplunkConfig.K8SClusterName)
 	}
+	if injRules.ContainerSelector == nil && injTempRules.ContainerSelector != nil {
+		injRules.ContainerSelector = injTempRules.ContainerSelector.DeepCopy()
+	}
 	///
 	return injRules
 }
@@ -506,6 +547,12 @@ func validateInjectionTemplates(injectionTemplates *InjectionTemplates) bool {
 			log.Printf("Injection template name is required but is empty\n")
 			valid = false
 		}
+		if injTemplate.InjectionRules != nil {
+			if _, err := newContainerSelector(injTemplate.InjectionRules.ContainerSelector); err != nil {
+				log.Printf("Error in injection template '%s': %v\n", injTemplate.Name, err)
+				valid = false
+			}
+		}
 	}
 
 	return valid
@@ -514,47 +561,18 @@ func validateInjectionTemplates(injectionTemplates *InjectionTemplates) bool {
 // validate instrumentation config
 func validateInstrumentationConfig(instrumentationConfig *InstrumentationConfig) bool {
 	valid := true
-	for _, instrRule := range *instrumentationConfig {
+	for idx, instrRule := range *instrumentationConfig {
 		if instrRule.Name == "" {
 			log.Printf("Instrumentation rule name is required but is empty\n")
 			valid = false
 		}
-		matchRules := instrRule.MatchRules
-		if matchRules.NamespaceRegex != "" {
-			_, err := regexp.Compile(matchRules.NamespaceRegex)
-			if err != nil {
-				log.Printf("Error in match rule '%s' namespace regex: %v", instrRule.Name, err)
-				valid = false
-			}
-		}
-		if matchRules.PodNameRegex != "" {
-			_, err := regexp.Compile(matchRules.PodNameRegex)
-			if err != nil {
-				log.Printf("Error in match rule '%s' pod name regex: %v", instrRule.Name, err)
-				valid = false
-			}
-		}
-		if matchRules.Annotations != nil {
-			for _, annotRule := range *matchRules.Annotations {
-				for annot, regex := range annotRule {
-					_, err := regexp.Compile(regex)
-					if err != nil {
-						log.Printf("Error in match rule '%s' annotation '%s' regex: %v", instrRule.Name, annot, err)
-						valid = false
-					}
-				}
-			}
+		errs, warnings := validateInstrumentationSpec(&instrRule, "", field.NewPath("instrumentation").Index(idx))
+		for _, err := range errs {
+			log.Printf("Error in instrumentation rule '%s': %v", instrRule.Name, err)
+			valid = false
 		}
-		if matchRules.Labels != nil {
-			for _, labelRule := range *matchRules.Labels {
-				for label, regex := range labelRule {
-					_, err := regexp.Compile(regex)
-					if err != nil {
-						log.Printf("Error in match rule '%s' label '%s' regex: %v", instrRule.Name, label, err)
-						valid = false
-					}
-				}
-			}
+		for _, warning := range warnings {
+			log.Printf("Warning in instrumentation rule '%s': %s", instrRule.Name, warning)
 		}
 	}
 	return valid
@@ -652,7 +670,9 @@ func configHandler() http.Handler {
 	})
 }
 
-func upsertCrdInstrumentation(namespace string, name string, instr v1alpha1.InstrumentationSpec) {
+// upsertCrdInstrumentation loads the Instrumentation rule. A rule which cannot be compiled is
+// rejected and its previous version, if any, is removed.
+func upsertCrdInstrumentation(namespace string, name string, instr v1alpha1.InstrumentationSpec) error {
 	config.mutex.Lock()
 	defer config.mutex.Unlock()
 
@@ -663,11 +683,11 @@ func upsertCrdInstrumentation(namespace string, name string, instr v1alpha1.Inst
 
 	ok := false
 	if _, ok = config.InstrumentationNamespacedCrds[namespace]; !ok {
-		config.InstrumentationNamespacedCrds[namespace] = &InstrumentationConfig{}
+		config.InstrumentationNamespacedCrds[namespace] = &InstrumentationRules{}
 	}
 	namespaceInstrs := config.InstrumentationNamespacedCrds[namespace]
 
-	upsertInstrumentationSpecInConfig(namespaceInstrs, namespace+"/"+name, instr)
+	return upsertInstrumentationSpecInConfig(namespaceInstrs, namespace+"/"+name, instr)
 }
 
 func deleteCrdInstrumentation(namespace string, name string) {
@@ -676,21 +696,22 @@ func deleteCrdInstrumentation(namespace string, name string) {
 
 	ok := false
 	if _, ok = config.InstrumentationNamespacedCrds[namespace]; !ok {
-		config.InstrumentationNamespacedCrds[namespace] = &InstrumentationConfig{}
+		config.InstrumentationNamespacedCrds[namespace] = &InstrumentationRules{}
 	}
 	namespaceInstrs := config.InstrumentationNamespacedCrds[namespace]
 
 	deleteInstrumentationSpecInConfig(namespaceInstrs, namespace+"/"+name)
 }
 
-func upsertCrdClusterInstrumentation(name string, instr v1alpha1.InstrumentationSpec) {
+// upsertCrdClusterInstrumentation loads the ClusterInstrumentation rule, see upsertCrdInstrumentation
+func upsertCrdClusterInstrumentation(name string, instr v1alpha1.InstrumentationSpec) error {
 	config.mutex.Lock()
 	defer config.mutex.Unlock()
 
 	// Instrumentation rule name is always taken from the CRD name
 	instr.Name = "*cluster*/" + name
 
-	upsertInstrumentationSpecInConfig(config.InstrumentationClusterCrds, "*cluster*/"+name, instr)
+	return upsertInstrumentationSpecInConfig(config.InstrumentationClusterCrds, "*cluster*/"+name, instr)
 }
 
 func deleteCrdClusterInstrumentation(name string) {
@@ -700,14 +721,20 @@ func deleteCrdClusterInstrumentation(name string) {
 	deleteInstrumentationSpecInConfig(config.InstrumentationClusterCrds, "*cluster*/"+name)
 }
 
-func upsertInstrumentationSpecInConfig(specs *InstrumentationConfig, name string, instr v1alpha1.InstrumentationSpec) {
+func upsertInstrumentationSpecInConfig(specs *InstrumentationRules, name string, instr v1alpha1.InstrumentationSpec) error {
 
 	log.Default().Printf("Upserting %s, %s", name, instr.Name)
 
+	rule, err := newInstrumentationRule(instr)
+	if err != nil {
+		deleteInstrumentationSpecInConfig(specs, name)
+		return err
+	}
+
 	found := false
 	for i, spec := range *specs {
 		if name == spec.Name {
-			(*specs)[i] = instr
+			(*specs)[i] = rule
 			found = true
 			break
 		}
@@ -715,21 +742,51 @@ func upsertInstrumentationSpecInConfig(specs *InstrumentationConfig, name string
 	log.Default().Printf("Upserting %s, %s, %t", name, instr.Name, found)
 
 	if !found {
-		(*specs) = append((*specs), instr)
+		(*specs) = append((*specs), rule)
 	}
 
-	slices.SortFunc((*specs), func(a, b v1alpha1.InstrumentationSpec) int {
-		if a.Priority > b.Priority {
-			return 1
-		} else if a.Priority == b.Priority {
-			return 0
-		} else {
-			return -1
+	// rules from CRDs with equal priority are ordered by name, so that the order does not depend
+	// on the order they were reconciled in
+	slices.SortFunc((*specs), func(a, b InstrumentationRule) int {
+		if c := compareRulePriority(a, b); c != 0 {
+			return c
 		}
+		return strings.Compare(a.Name, b.Name)
 	})
+	return nil
+}
+
+// compareRulePriority orders rules with higher priority first
+func compareRulePriority(a, b InstrumentationRule) int {
+	return cmp.Compare(b.Priority, a.Priority)
+}
+
+// parseRuleSourcePrecedence parses yaml list of rule sources. Sources not listed follow the listed ones
+// in the default order.
+func parseRuleSourcePrecedence(ruleSourcePrecedenceConfig string) ([]string, error) {
+	listed := []string{}
+	if err := yaml.Unmarshal([]byte(ruleSourcePrecedenceConfig), &listed); err != nil {
+		return nil, err
+	}
+	precedence := []string{}
+	for _, source := range listed {
+		if !slices.Contains(defaultRuleSourcePrecedence, source) {
+			return nil, fmt.Errorf("unknown rule source %s, expected one of %v", source, defaultRuleSourcePrecedence)
+		}
+		if slices.Contains(precedence, source) {
+			return nil, fmt.Errorf("rule source %s listed more than once", source)
+		}
+		precedence = append(precedence, source)
+	}
+	for _, source := range defaultRuleSourcePrecedence {
+		if !slices.Contains(precedence, source) {
+			precedence = append(precedence, source)
+		}
+	}
+	return precedence, nil
 }
 
-func deleteInstrumentationSpecInConfig(specs *InstrumentationConfig, name string) {
+func deleteInstrumentationSpecInConfig(specs *InstrumentationRules, name string) {
 	found := -1
 	for i, spec := range *specs {
 		if name == spec.Name {
@@ -742,14 +799,37 @@ func deleteInstrumentationSpecInConfig(specs *InstrumentationConfig, name string
 	}
 }
 
+func suspendInstrumentation(suspendConfig string) {
+	suspended := false
+	if suspendConfig != "" {
+		var err error
+		if suspended, err = strconv.ParseBool(suspendConfig); err != nil {
+			// better safe than sorry, value meant to suspend instrumentation may be just mistyped
+			log.Printf("Error parsing %s value %s, suspending instrumentation: %v\n", SUSPEND_INSTRUMENTATION_CONFIG_KEY, suspendConfig, err)
+			suspended = true
+		}
+	}
+
+	config.mutex.Lock()
+	defer config.mutex.Unlock()
+	if suspended != config.InstrumentationSuspended {
+		log.Printf("Instrumentation suspended: %t\n", suspended)
+	}
+	config.InstrumentationSuspended = suspended
+}
+
 func instrumentationAsString() string {
+	otelCollsConfigMutex.Lock()
 	otelCollsConfigStr, _ := json.MarshalIndent(otelCollsConfig, "", "  ")
 	otelCollsConfigNamespacedStr, _ := json.MarshalIndent(otelCollsConfigNamespaced, "", "  ")
+	otelCollsConfigMutex.Unlock()
 	instrumentationConfigStr, _ := json.MarshalIndent(config.InstrumentationConfig, "", "  ")
 	instrumentationNamespacedStr, _ := json.MarshalIndent(config.InstrumentationNamespacedCrds, "", "  ")
 	instrumentationClusterStr, _ := json.MarshalIndent(config.InstrumentationClusterCrds, "", "  ")
 
 	configStr := fmt.Sprintf(`
+	Instrumentation suspended: %t
+
 	OpenTelemetry Collectors from config map
 	========================================================================================
 	%s
@@ -771,6 +851,7 @@ func instrumentationAsString() string {
 	%s
 	
 	`,
+		config.InstrumentationSuspended,
 		string(otelCollsConfigStr),
 		string(otelCollsConfigNamespacedStr),
 		string(instrumentationConfigStr),
@@ -0,0 +1,147 @@
+/*
+Copyright (c) 2019 Cisco Systems, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"v1alpha1"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// names of service mesh proxies and other well known sidecars, which are not application containers
+var SIDECAR_CONTAINER_NAMES = []string{
+	"istio-proxy",
+	"linkerd-proxy",
+	"daprd",
+	"vault-agent",
+	"cloud-sql-proxy",
+}
+
+// isApplicationContainer tells whether the container runs the application, rather than being a sidecar
+// or a container injected by the instrumentation
+func isApplicationContainer(name string) bool {
+	if slices.Contains(SIDECAR_CONTAINER_NAMES, name) {
+		return false
+	}
+	for _, prefix := range INSTRUMENTATION_CONTAINER_PREFIXES {
+		if strings.HasPrefix(name, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// technologies instrumented through a copy of the web server configuration, which is shared by the pod,
+// so a single container can be instrumented only
+var SINGLE_CONTAINER_TECHNOLOGIES = []string{
+	"apache",
+	"nginx",
+}
+
+// containerSelector is the container selector of an injection rule with the regexes compiled
+type containerSelector struct {
+	name                     string
+	nameRegex                *regexp.Regexp
+	imageRegex               *regexp.Regexp
+	allApplicationContainers bool
+}
+
+// newContainerSelector compiles the container selector, nil for no selector or an empty one
+func newContainerSelector(selector *v1alpha1.ContainerSelector) (*containerSelector, error) {
+	if selector == nil {
+		return nil, nil
+	}
+	compiled := &containerSelector{
+		name:                     selector.Name,
+		allApplicationContainers: selector.AllApplicationContainers != nil && *selector.AllApplicationContainers,
+	}
+	var err error
+	if selector.NameRegex != "" {
+		if compiled.nameRegex, err = regexp.Compile(selector.NameRegex); err != nil {
+			return nil, fmt.Errorf("invalid container selector nameRegex %q: %v", selector.NameRegex, err)
+		}
+	}
+	if selector.ImageRegex != "" {
+		if compiled.imageRegex, err = regexp.Compile(selector.ImageRegex); err != nil {
+			return nil, fmt.Errorf("invalid container selector imageRegex %q: %v", selector.ImageRegex, err)
+		}
+	}
+	if compiled.name == "" && compiled.nameRegex == nil && compiled.imageRegex == nil && !compiled.allApplicationContainers {
+		return nil, nil
+	}
+	return compiled, nil
+}
+
+// newContainerSelectors compiles container selectors of the injection rules of the spec, in the order
+// of injectionRulesOf
+func newContainerSelectors(spec *v1alpha1.InstrumentationSpec) ([]*containerSelector, error) {
+	selectors := []*containerSelector{}
+	for _, injectionRule := range injectionRulesOf(spec) {
+		selector, err := newContainerSelector(injectionRule.ContainerSelector)
+		if err != nil {
+			return nil, err
+		}
+		selectors = append(selectors, selector)
+	}
+	return selectors, nil
+}
+
+// injectionRulesOf lists the injection rules of the spec, rules of the rule set, or the single injection rule
+func injectionRulesOf(spec *v1alpha1.InstrumentationSpec) []v1alpha1.InjectionRule {
+	if len(spec.InjectionRuleSet) > 0 {
+		return spec.InjectionRuleSet
+	}
+	if spec.InjectionRules != nil {
+		return []v1alpha1.InjectionRule{*spec.InjectionRules}
+	}
+	return []v1alpha1.InjectionRule{}
+}
+
+// selectContainers returns indexes of the containers the injection rule applies to. Without the container
+// selector, it's the default container selected by the match rules.
+func selectContainers(pod *corev1.Pod, selector *containerSelector, defaultIdx int) ([]int, error) {
+	if selector == nil {
+		return []int{defaultIdx}, nil
+	}
+
+	containerIdxs := []int{}
+	for idx, container := range pod.Spec.Containers {
+		if selector.name != "" && container.Name != selector.name {
+			continue
+		}
+		// sidecar can be selected only by name explicitly
+		if selector.name == "" && !isApplicationContainer(container.Name) {
+			continue
+		}
+		if selector.nameRegex != nil && !selector.nameRegex.MatchString(container.Name) {
+			continue
+		}
+		if selector.imageRegex != nil && !selector.imageRegex.MatchString(container.Image) {
+			continue
+		}
+		containerIdxs = append(containerIdxs, idx)
+	}
+
+	if len(containerIdxs) == 0 {
+		return nil, fmt.Errorf("no container matches container selector")
+	}
+	return containerIdxs, nil
+}
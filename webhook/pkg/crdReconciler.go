@@ -5,19 +5,23 @@ import (
 	"fmt"
 	"os"
 	"reflect"
+	"time"
 	"v1alpha1"
 
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/wait"
 	clientappsv1 "k8s.io/client-go/kubernetes/typed/apps/v1"
 	clientcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	"k8s.io/client-go/rest"
+	"k8s.io/utils/ptr"
 	ctrl "sigs.k8s.io/controller-runtime"
 	clientk8s "sigs.k8s.io/controller-runtime/pkg/client"
 	configK8s "sigs.k8s.io/controller-runtime/pkg/client/config"
@@ -27,19 +31,35 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 	"sigs.k8s.io/controller-runtime/pkg/manager/signals"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	sourceK8s "sigs.k8s.io/controller-runtime/pkg/source"
 )
 
-func startCrdReconciler() {
+// ReconcilerConfig controls how the controller manager coordinates with the other webhook replicas
+type ReconcilerConfig struct {
+	LeaderElect      bool
+	LeaderElectionID string
+	Namespace        string
+}
+
+func startCrdReconciler(reconcilerConfig ReconcilerConfig) {
 	entryLog := log.Log.WithName("instr-controller")
 
 	// Setup a Manager
-	entryLog.Info("setting up manager")
+	// Every replica watches the CRDs to keep its registries in sync for admissions, but only the elected
+	// leader writes to the cluster (processingStatus annotations, collector Deployments and Services).
+	entryLog.Info("setting up manager", "leaderElect", reconcilerConfig.LeaderElect)
 	mgr, err := manager.New(configK8s.GetConfigOrDie(), manager.Options{
 		Scheme: scheme,
+		// controller metrics are served by the webhook server on /metrics, see registerMetricsHandler
+		Metrics:                       metricsserver.Options{BindAddress: "0"},
+		LeaderElection:                reconcilerConfig.LeaderElect,
+		LeaderElectionID:              reconcilerConfig.LeaderElectionID,
+		LeaderElectionNamespace:       reconcilerConfig.Namespace,
+		LeaderElectionReleaseOnCancel: true,
 	})
 
 	if err != nil {
@@ -51,6 +71,8 @@ func startCrdReconciler() {
 	entryLog.Info("Setting up instr-controller")
 	instrController, err := controller.New("instr-controller", mgr, controller.Options{
 		Reconciler: &reconcileInstrCrd{client: mgr.GetClient()},
+		// registries are needed for admissions on all replicas, not only on the leader
+		NeedLeaderElection: ptr.To(false),
 	})
 	if err != nil {
 		entryLog.Error(err, "unable to set up instr-controller")
@@ -60,12 +82,39 @@ func startCrdReconciler() {
 	entryLog.Info("Setting up ginstr-controller")
 	gInstrController, err := controller.New("ginstr-controller", mgr, controller.Options{
 		Reconciler: &reconcileGInstrCrd{client: mgr.GetClient()},
+		// registries are needed for admissions on all replicas, not only on the leader
+		NeedLeaderElection: ptr.To(false),
 	})
 	if err != nil {
 		entryLog.Error(err, "unable to set up ginstr-controller")
 		os.Exit(1)
 	}
 
+	entryLog.Info("Setting up instr-status-controller")
+	instrStatusController, err := controller.New("instr-status-controller", mgr, controller.Options{
+		Reconciler: &reconcileProcessingStatus{client: mgr.GetClient(), newObject: func() clientk8s.Object { return &v1alpha1.Instrumentation{} }},
+	})
+	if err != nil {
+		entryLog.Error(err, "unable to set up instr-status-controller")
+		os.Exit(1)
+	}
+
+	entryLog.Info("Setting up ginstr-status-controller")
+	gInstrStatusController, err := controller.New("ginstr-status-controller", mgr, controller.Options{
+		Reconciler: &reconcileProcessingStatus{client: mgr.GetClient(), newObject: func() clientk8s.Object { return &v1alpha1.ClusterInstrumentation{} }},
+	})
+	if err != nil {
+		entryLog.Error(err, "unable to set up ginstr-status-controller")
+		os.Exit(1)
+	}
+
+	entryLog.Info("Setting up otelcol-registry-controller")
+	err = (&reconcileOtelColRegistry{client: mgr.GetClient()}).SetupWithManager(mgr)
+	if err != nil {
+		entryLog.Error(err, "unable to set up otelcol-registry-controller")
+		os.Exit(1)
+	}
+
 	entryLog.Info("Setting up otelcol-controller")
 
 	reconciler := &reconcileOtelColCrd{client: mgr.GetClient()}
@@ -89,18 +138,84 @@ func startCrdReconciler() {
 		entryLog.Error(err, "unable to watch ClusterInstrumentation")
 		os.Exit(1)
 	}
+	if err := instrStatusController.Watch(sourceK8s.Kind(mgr.GetCache(), &v1alpha1.Instrumentation{}), &handler.EnqueueRequestForObject{}); err != nil {
+		entryLog.Error(err, "unable to watch Instrumentation")
+		os.Exit(1)
+	}
+	if err := gInstrStatusController.Watch(sourceK8s.Kind(mgr.GetCache(), &v1alpha1.ClusterInstrumentation{}), &handler.EnqueueRequestForObject{}); err != nil {
+		entryLog.Error(err, "unable to watch ClusterInstrumentation")
+		os.Exit(1)
+	}
 	// Watch OpenTelemetry collector
 	// if err := otelcolController.Watch(sourceK8s.Kind(mgr.GetCache(), &v1alpha1.OpenTelemetryCollector{}), &handler.EnqueueRequestForObject{}); err != nil {
 	// 	entryLog.Error(err, "unable to watch OpenTelemetryCollector")
 	// 	os.Exit(1)
 	// }
+	ctx := signals.SetupSignalHandler()
+
+	// readiness of the webhook depends on the registries being loaded from the synced caches, see crdCachesSyncedCheck
+	go func() {
+		if !mgr.GetCache().WaitForCacheSync(ctx) {
+			return
+		}
+		entryLog.Info("CRD caches synced")
+		err := wait.PollUntilContextCancel(ctx, REGISTRY_PRELOAD_RETRY_INTERVAL, true, func(ctx context.Context) (bool, error) {
+			if err := preloadRegistries(ctx, mgr); err != nil {
+				entryLog.Error(err, "Cannot load registries from CRD caches, retrying")
+				return false, nil
+			}
+			return true, nil
+		})
+		if err == nil {
+			entryLog.Info("Registries loaded from CRD caches")
+			crdCachesSynced.Store(true)
+		}
+	}()
+
 	entryLog.Info("starting manager")
-	if err := mgr.Start(signals.SetupSignalHandler()); err != nil {
+	if err := mgr.Start(ctx); err != nil {
 		entryLog.Error(err, "unable to run manager")
 		os.Exit(1)
 	}
 }
 
+// REGISTRY_PRELOAD_RETRY_INTERVAL paces loading the registries again when listing the cached resources fails
+const REGISTRY_PRELOAD_RETRY_INTERVAL = 5 * time.Second
+
+// preloadRegistries loads the Instrumentation, ClusterInstrumentation and OpenTelemetryCollector resources already
+// in the synced caches into the registries. The controllers reconcile them as well, but only after the caches
+// synced, and admissions must not start before the registries hold every existing rule and collector.
+func preloadRegistries(ctx context.Context, mgr manager.Manager) error {
+	preloads := []struct {
+		list       clientk8s.ObjectList
+		reconciler reconcile.Reconciler
+	}{
+		{&v1alpha1.InstrumentationList{}, &reconcileInstrCrd{client: mgr.GetClient()}},
+		{&v1alpha1.ClusterInstrumentationList{}, &reconcileGInstrCrd{client: mgr.GetClient()}},
+		{&v1alpha1.OpenTelemetryCollectorList{}, &reconcileOtelColRegistry{client: mgr.GetClient()}},
+	}
+	for _, preload := range preloads {
+		if err := mgr.GetCache().List(ctx, preload.list); err != nil {
+			return err
+		}
+		items, err := meta.ExtractList(preload.list)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			obj, ok := item.(clientk8s.Object)
+			if !ok {
+				continue
+			}
+			request := reconcile.Request{NamespacedName: clientk8s.ObjectKeyFromObject(obj)}
+			if _, err := preload.reconciler.Reconcile(ctx, request); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 type reconcileInstrCrd struct {
 	client clientk8s.Client
 }
@@ -131,16 +246,9 @@ func (r *reconcileInstrCrd) Reconcile(ctx context.Context, request reconcile.Req
 	} else {
 		log.Info("Upserting Instrumentation", "data", *instr)
 		injectionRuleDefaults(instr.Spec.InjectionRules)
-		upsertCrdInstrumentation(request.Namespace, instr.Name, instr.Spec)
-		// Set the label if it is missing
-		if instr.Annotations == nil {
-			instr.Annotations = map[string]string{}
-		}
-		instr.Annotations["processingStatus"] = "processed"
-
-		err = r.client.Update(ctx, instr)
-		if err != nil {
-			return reconcile.Result{}, fmt.Errorf("could not write Instrumentation: %+v", err)
+		if err := upsertCrdInstrumentation(request.Namespace, instr.Name, instr.Spec); err != nil {
+			// not requeued, the rule is loaded again when the resource changes
+			log.Error(err, "Rejecting invalid Instrumentation", "name", instr.Name)
 		}
 	}
 
@@ -177,22 +285,122 @@ func (r *reconcileGInstrCrd) Reconcile(ctx context.Context, request reconcile.Re
 	} else {
 		log.Info("Upserting ClusterInstrumentation", "data", *instr)
 		injectionRuleDefaults(instr.Spec.InjectionRules)
-		upsertCrdClusterInstrumentation(instr.Name, instr.Spec)
-		// Set the label if it is missing
-		if instr.Annotations == nil {
-			instr.Annotations = map[string]string{}
+		if err := upsertCrdClusterInstrumentation(instr.Name, instr.Spec); err != nil {
+			// not requeued, the rule is loaded again when the resource changes
+			log.Error(err, "Rejecting invalid ClusterInstrumentation", "name", instr.Name)
 		}
-		instr.Annotations["processingStatus"] = "processed"
+	}
 
-		err = r.client.Update(ctx, instr)
-		if err != nil {
-			return reconcile.Result{}, fmt.Errorf("could not write ClusterInstrumentation: %+v", err)
-		}
+	return reconcile.Result{}, nil
+}
+
+type reconcileProcessingStatus struct {
+	client    clientk8s.Client
+	newObject func() clientk8s.Object
+}
+
+// Implement reconcile.Reconciler so the controller can reconcile objects
+var _ reconcile.Reconciler = &reconcileProcessingStatus{}
+
+// Reconcile marks Instrumentation and ClusterInstrumentation objects as processed. It runs on the leader only,
+// so that replicas do not compete updating the same objects.
+func (r *reconcileProcessingStatus) Reconcile(ctx context.Context, request reconcile.Request) (reconcile.Result, error) {
+	obj := r.newObject()
+	err := r.client.Get(ctx, request.NamespacedName, obj)
+	if errors.IsNotFound(err) {
+		return reconcile.Result{}, nil
+	}
+	if err != nil {
+		return reconcile.Result{}, fmt.Errorf("could not fetch %T: %+v", obj, err)
+	}
+	if !obj.GetDeletionTimestamp().IsZero() {
+		return reconcile.Result{}, nil
+	}
+
+	annotations := obj.GetAnnotations()
+	if annotations["processingStatus"] == "processed" {
+		return reconcile.Result{}, nil
+	}
+	// Set the annotation if it is missing
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations["processingStatus"] = "processed"
+	obj.SetAnnotations(annotations)
+
+	err = r.client.Update(ctx, obj)
+	if err != nil {
+		return reconcile.Result{}, fmt.Errorf("could not write %T: %+v", obj, err)
 	}
 
 	return reconcile.Result{}, nil
 }
 
+type reconcileOtelColRegistry struct {
+	client clientk8s.Client
+}
+
+// Implement reconcile.Reconciler so the controller can reconcile objects
+var _ reconcile.Reconciler = &reconcileOtelColRegistry{}
+
+func (r *reconcileOtelColRegistry) SetupWithManager(mgr manager.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("otelcol-registry-controller").
+		For(&v1alpha1.OpenTelemetryCollector{}).
+		WithEventFilter(predicate.GenerationChangedPredicate{}).
+		WithOptions(controller.Options{
+			// collectors must be known on all replicas to instrument pods
+			NeedLeaderElection: ptr.To(false),
+		}).
+		Complete(r)
+}
+
+// Reconcile keeps the collector registry used by admissions in sync, the collector
+// Deployment and Service are managed by the leader in reconcileOtelColCrd
+func (r *reconcileOtelColRegistry) Reconcile(ctx context.Context, request reconcile.Request) (reconcile.Result, error) {
+	log := log.FromContext(ctx)
+
+	otelcol := &v1alpha1.OpenTelemetryCollector{}
+	err := r.client.Get(ctx, request.NamespacedName, otelcol)
+	if errors.IsNotFound(err) {
+		log.Info("Unregistering OpenTelemetryCollector", "name", request.Name)
+		unregisterNamespacedCollector(request.Namespace, request.Name)
+		return reconcile.Result{}, nil
+	}
+
+	if err != nil {
+		return reconcile.Result{}, fmt.Errorf("could not fetch OpenTelemetryCollector: %+v", err)
+	}
+
+	if !otelcol.DeletionTimestamp.IsZero() {
+		log.Info("Unregistering OpenTelemetryCollector", "name", request.Name)
+		unregisterNamespacedCollector(request.Namespace, request.Name)
+		return reconcile.Result{}, nil
+	}
+
+	log.Info("Registering OpenTelemetryCollector", "name", request.Name)
+	otelColDefaults(&otelcol.Spec)
+	// if sidecar definition, which is only config as such, register it for later use
+	// when instrumented pods are instatiated
+	if otelcol.Spec.Mode == v1alpha1.ModeSidecar {
+		registerNamespacedSidecarCollector(request.Namespace, otelcol)
+	} else {
+		registerNamespacedStandaloneCollector(request.Namespace, otelcol)
+	}
+
+	return reconcile.Result{}, nil
+}
+
+// otelColDefaults fills in the collector image and replicas when not specified
+func otelColDefaults(spec *v1alpha1.OpenTelemetryCollectorSpec) {
+	if spec.Image == "" {
+		spec.Image = "otel/opentelemetry-collector-contrib:latest"
+	}
+	if spec.Replicas == nil {
+		spec.Replicas = int32Ptr(1)
+	}
+}
+
 type reconcileOtelColCrd struct {
 	client clientk8s.Client
 	Scheme *runtime.Scheme
@@ -240,8 +448,7 @@ func (r *reconcileOtelColCrd) Reconcile(ctx context.Context, request reconcile.R
 }
 
 func (r *reconcileOtelColCrd) deleteOtelCollector(ctx context.Context, namespace string, name string) error {
-
-	unregisterNamespacedCollector(namespace, name)
+	// Deployment and Service are garbage collected through their controller reference
 	return nil
 }
 
@@ -257,10 +464,8 @@ func (r *reconcileOtelColCrd) upsertOtelCollector(ctx context.Context, namespace
 
 	name = OTELCOL_RESOURCE_PREFIX + name
 
-	// if sidecar definition, which is only config as such, register it for later use
-	// when instrumented pods are instatiated
+	// sidecar definition is only config as such, there are no collector pods to instantiate
 	if otelcol.Spec.Mode == v1alpha1.ModeSidecar {
-		registerNamespacedSidecarCollector(namespace, otelcol)
 		return nil
 	}
 
@@ -312,12 +517,7 @@ func (r *reconcileOtelColCrd) upsertOtelCollector(ctx context.Context, namespace
 
 	initScript := "echo \"" + otelcol.Spec.Config + "\" > /conf/otel-collector-config.yaml"
 
-	if otelcol.Spec.Image == "" {
-		otelcol.Spec.Image = "otel/opentelemetry-collector-contrib:latest"
-	}
-	if otelcol.Spec.Replicas == nil {
-		otelcol.Spec.Replicas = int32Ptr(1)
-	}
+	otelColDefaults(&otelcol.Spec)
 
 	otelcolDeployment := &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
@@ -502,8 +702,6 @@ func (r *reconcileOtelColCrd) upsertOtelCollector(ctx context.Context, namespace
 		}
 	}
 
-	registerNamespacedStandaloneCollector(namespace, otelcol)
-
 	return nil
 }
 
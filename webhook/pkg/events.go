@@ -0,0 +1,104 @@
+/*
+Copyright (c) 2019 Cisco Systems, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+	"v1alpha1"
+
+	corev1 "k8s.io/api/core/v1"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const EVENT_COMPONENT = "webhook-instrumentor"
+
+// reasons of the events emitted for instrumentation outcomes
+const (
+	EVENT_REASON_INSTRUMENTED  = "Instrumented"
+	EVENT_REASON_FAILED        = "InstrumentationFailed"
+	EVENT_REASON_RULE_CONFLICT = "InstrumentationRuleConflict"
+)
+
+var (
+	eventRecorder     record.EventRecorder
+	eventRecorderOnce sync.Once
+)
+
+func getEventRecorder() record.EventRecorder {
+	eventRecorderOnce.Do(func() {
+		broadcaster := record.NewBroadcaster()
+		broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+		eventRecorder = broadcaster.NewRecorder(scheme, corev1.EventSource{Component: EVENT_COMPONENT})
+	})
+	return eventRecorder
+}
+
+// recordInstrumentationEvents emits an event per injection rule applied to the pod. When any of the injection
+// rules failed, nothing was applied, so only the failures are reported. The pod does not exist yet at admission
+// time, so events go to the owning workload, or to the namespace for bare pods.
+func recordInstrumentationEvents(pod corev1.Pod, instrRule *v1alpha1.InstrumentationSpec, outcomes []injectionOutcome) {
+	ref := getEventTarget(pod)
+	recorder := getEventRecorder()
+	failed := injectionFailed(outcomes)
+	for _, outcome := range outcomes {
+		if outcome.Failure == "" {
+			if failed {
+				continue
+			}
+			recorder.Eventf(ref, corev1.EventTypeNormal, EVENT_REASON_INSTRUMENTED,
+				"Pod %s instrumented by rule %s: technology %s, image %s",
+				pod.GetName(), instrRule.Name, outcome.Technology, outcome.Image)
+		} else {
+			recorder.Eventf(ref, corev1.EventTypeWarning, EVENT_REASON_FAILED,
+				"Pod %s not instrumented by rule %s: technology %s, image %s: %s",
+				pod.GetName(), instrRule.Name, outcome.Technology, outcome.Image, outcome.Failure)
+		}
+	}
+}
+
+// recordRuleConflictEvents warns about rules overlapping with the rule which decided about the pod
+func recordRuleConflictEvents(pod corev1.Pod, conflicts []ruleConflict) {
+	ref := getEventTarget(pod)
+	recorder := getEventRecorder()
+	for _, conflict := range conflicts {
+		recorder.Eventf(ref, corev1.EventTypeWarning, EVENT_REASON_RULE_CONFLICT,
+			"Pod %s matches rule %s with the same priority %d as rule %s, which was applied",
+			pod.GetName(), conflict.conflicting, conflict.priority, conflict.rule)
+	}
+}
+
+// getEventTarget resolves the workload owning the pod, so that events show up where app teams look for them
+func getEventTarget(pod corev1.Pod) *corev1.ObjectReference {
+	owner := getWorkloadOwner(pod)
+	if owner == nil {
+		return &corev1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "Namespace",
+			Name:       pod.GetNamespace(),
+			Namespace:  pod.GetNamespace(),
+		}
+	}
+
+	return &corev1.ObjectReference{
+		APIVersion: owner.APIVersion,
+		Kind:       owner.Kind,
+		Name:       owner.Name,
+		Namespace:  pod.GetNamespace(),
+		UID:        owner.UID,
+	}
+}
@@ -0,0 +1,148 @@
+/*
+Copyright (c) 2019 Cisco Systems, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// results of evaluation of a single rule
+const (
+	RULE_EVALUATION_MATCHED     = "matched"
+	RULE_EVALUATION_NOT_MATCHED = "notMatched"
+	RULE_EVALUATION_EXCLUDED    = "excluded"
+	RULE_EVALUATION_CONFLICT    = "conflict"
+	RULE_EVALUATION_INACTIVE    = "inactive"
+)
+
+// RuleEvaluation is the outcome of checking the pod against one rule
+type RuleEvaluation struct {
+	Rule   string `json:"rule"`
+	Source string `json:"source"`
+	Result string `json:"result"`
+	// Reason is the criterion which did not match, or how the rule was selected
+	Reason string `json:"reason,omitempty"`
+}
+
+// matchTrace records the rules evaluated for the pod in evaluation order and the final decision
+type matchTrace struct {
+	Evaluations []RuleEvaluation
+	Decision    string
+}
+
+// ExplainResponse tells why the pod is, or is not, instrumented
+type ExplainResponse struct {
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	// AlreadyInstrumented is the reason the pod would be left as is, because it was instrumented before
+	AlreadyInstrumented string `json:"alreadyInstrumented,omitempty"`
+	Decision            string `json:"decision"`
+	Rule                string `json:"rule,omitempty"`
+	RuleSource          string `json:"ruleSource,omitempty"`
+	// Rules are all rules considered, in evaluation order, up to the one deciding, followed by rules
+	// matching with the same priority as the deciding one
+	Rules []RuleEvaluation `json:"rules"`
+}
+
+func (t *matchTarget) record(rule string, ruleSource string, result string, reason string) {
+	if t.trace != nil {
+		t.trace.Evaluations = append(t.trace.Evaluations, RuleEvaluation{Rule: rule, Source: ruleSource, Result: result, Reason: reason})
+	}
+}
+
+func (t *matchTarget) decide(decision string) {
+	if t.trace != nil {
+		t.trace.Decision = decision
+	}
+}
+
+// explainHandler serves POST with a pod, or a workload the same as for preview, in the body. Pods existing
+// in the cluster are not read on behalf of the caller, the caller submits the pod to explain.
+func explainHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			log.Log.Info("Explain unsupported method called", "method", r.Method)
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not read explain request: %v", err), http.StatusBadRequest)
+			return
+		}
+		pod, workloadOwner, err := previewPod(PreviewRequest{
+			Namespace: r.URL.Query().Get("namespace"),
+			Object:    runtime.RawExtension{Raw: body},
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if config.ControllerConfig == nil || config.InstrumentationConfig == nil {
+			http.Error(w, "instrumentor configuration not read from configmap", http.StatusServiceUnavailable)
+			return
+		}
+
+		explainResponse := explainInstrumentation(pod, workloadOwner)
+
+		w.Header().Set("Content-Type", "application/json")
+		if err = json.NewEncoder(w).Encode(explainResponse); err != nil {
+			log.Log.Error(err, "cannot write explain response")
+		}
+	})
+}
+
+// explainInstrumentation runs the matching the same way as the admission does and records every rule evaluated
+func explainInstrumentation(pod corev1.Pod, workloadOwner *metav1.OwnerReference) *ExplainResponse {
+	explainResponse := &ExplainResponse{
+		Namespace: pod.GetNamespace(),
+		Pod:       pod.GetName(),
+		Rules:     []RuleEvaluation{},
+	}
+
+	target := newMatchTarget(pod)
+	if workloadOwner != nil {
+		target.owner, target.ownerResolved = workloadOwner, true
+	}
+	target.trace = &matchTrace{}
+
+	instrumentationRule, ruleSource := matchInstrumentationRule(target)
+	if instrumentationRule != nil {
+		explainResponse.Rule = instrumentationRule.Name
+		explainResponse.RuleSource = ruleSource
+	}
+	explainResponse.Decision = target.trace.Decision
+	explainResponse.Rules = append(explainResponse.Rules, target.trace.Evaluations...)
+
+	// rules are still evaluated for pods admitted before, so that the response tells what current rules would do
+	if explainResponse.AlreadyInstrumented = alreadyInstrumented(pod); explainResponse.AlreadyInstrumented != "" {
+		explainResponse.Decision = "left as is, already instrumented"
+	}
+
+	return explainResponse
+}
@@ -0,0 +1,116 @@
+/*
+Copyright (c) 2019 Cisco Systems, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/google/cel-go/cel"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// variables available to match rule expressions, all objects in the same structure as in the Kubernetes API
+const (
+	EXPRESSION_POD_VAR       = "pod"
+	EXPRESSION_NAMESPACE_VAR = "namespace"
+	EXPRESSION_OWNER_VAR     = "owner"
+)
+
+// limits runtime cost of a single expression evaluation, so that a rule cannot stall admission
+const EXPRESSION_COST_LIMIT = 1000000
+
+var expressionEnv *cel.Env
+
+func init() {
+	var err error
+	objectType := cel.MapType(cel.StringType, cel.DynType)
+	expressionEnv, err = cel.NewEnv(
+		cel.Variable(EXPRESSION_POD_VAR, objectType),
+		cel.Variable(EXPRESSION_NAMESPACE_VAR, objectType),
+		cel.Variable(EXPRESSION_OWNER_VAR, objectType),
+		cel.OptionalTypes(),
+	)
+	if err != nil {
+		log.Fatalf("Cannot create match expression environment: %v", err)
+	}
+}
+
+// compileMatchExpression parses and type-checks the expression, which must evaluate to bool. It also tells
+// whether the expression refers to the owner, which takes an API call to look up.
+func compileMatchExpression(expression string) (cel.Program, bool, error) {
+	ast, issues := expressionEnv.Compile(expression)
+	if issues != nil && issues.Err() != nil {
+		return nil, false, issues.Err()
+	}
+	if ast.OutputType() != cel.BoolType {
+		return nil, false, fmt.Errorf("expression must evaluate to bool, not %s", ast.OutputType())
+	}
+	checked, err := cel.AstToCheckedExpr(ast)
+	if err != nil {
+		return nil, false, err
+	}
+	usesOwner := false
+	for _, reference := range checked.GetReferenceMap() {
+		if reference.GetName() == EXPRESSION_OWNER_VAR {
+			usesOwner = true
+		}
+	}
+	program, err := expressionEnv.Program(ast, cel.CostLimit(EXPRESSION_COST_LIMIT))
+	return program, usesOwner, err
+}
+
+// evalMatchExpression evaluates the expression on the target. Namespace and owner are looked up
+// only if the expression refers to them. Evaluation errors, like access to a missing field, do not match.
+func evalMatchExpression(program cel.Program, target *matchTarget) (bool, error) {
+	vars := map[string]any{
+		EXPRESSION_POD_VAR: func() any {
+			return toExpressionObject(&target.pod)
+		},
+		EXPRESSION_NAMESPACE_VAR: func() any {
+			ns, err := target.getNamespace()
+			if err != nil {
+				log.Printf("Cannot get namespace %s to match: %v\n", target.pod.GetNamespace(), err)
+				return map[string]any{}
+			}
+			return toExpressionObject(ns)
+		},
+		EXPRESSION_OWNER_VAR: func() any {
+			owner := target.getOwner()
+			if owner == nil {
+				return map[string]any{}
+			}
+			return toExpressionObject(owner)
+		},
+	}
+
+	result, _, err := program.Eval(vars)
+	if err != nil {
+		return false, err
+	}
+	matched, isBool := result.Value().(bool)
+	return isBool && matched, nil
+}
+
+func toExpressionObject(obj any) map[string]any {
+	unstructured, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		log.Printf("Cannot convert %T for expression: %v\n", obj, err)
+		return map[string]any{}
+	}
+	return unstructured
+}
@@ -0,0 +1,67 @@
+/*
+Copyright (c) 2019 Cisco Systems, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+)
+
+// crdCachesSynced is set once the informer caches of the CRD manager have synced and the registries
+// were loaded from them, see startCrdReconciler
+var crdCachesSynced atomic.Bool
+
+// configLoadedCheck is ready once controller and instrumentation configuration was read from the config map
+func configLoadedCheck(_ *http.Request) error {
+	config.mutex.Lock()
+	defer config.mutex.Unlock()
+
+	if config.ControllerConfig == nil || config.InstrumentationConfig == nil {
+		return errors.New("instrumentor configuration not read from configmap")
+	}
+	return nil
+}
+
+// crdCachesSyncedCheck is ready once Instrumentation, ClusterInstrumentation and OpenTelemetryCollector
+// resources were listed by the CRD manager and loaded into the registries
+func crdCachesSyncedCheck(_ *http.Request) error {
+	if !crdCachesSynced.Load() {
+		return errors.New("instrumentation CRD caches not synced")
+	}
+	return nil
+}
+
+// registerHealthHandlers adds /healthz (liveness) and /readyz (readiness, startup) endpoints to the mux.
+// Individual checks are reachable as sub-paths, e.g. /readyz/config, and ?verbose lists all of them.
+func registerHealthHandlers(mux *http.ServeMux) {
+	healthzHandler := &healthz.Handler{Checks: map[string]healthz.Checker{
+		"ping": healthz.Ping,
+	}}
+	readyzHandler := &healthz.Handler{Checks: map[string]healthz.Checker{
+		"config":     configLoadedCheck,
+		"crd-caches": crdCachesSyncedCheck,
+		"namespaces": namespacesSyncedCheck,
+	}}
+
+	mux.Handle("/healthz", http.StripPrefix("/healthz", healthzHandler))
+	mux.Handle("/healthz/", http.StripPrefix("/healthz", healthzHandler))
+	mux.Handle("/readyz", http.StripPrefix("/readyz", readyzHandler))
+	mux.Handle("/readyz/", http.StripPrefix("/readyz", readyzHandler))
+}
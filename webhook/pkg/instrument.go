@@ -19,13 +19,16 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"log"
+	"slices"
 	"strconv"
 	"strings"
 	"v1alpha1"
 
+	"gomodules.xyz/jsonpatch/v2"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
@@ -38,173 +41,291 @@ type TemplateParams struct {
 	Namespace            string
 }
 
-func instrument(pod corev1.Pod, instrRule *v1alpha1.InstrumentationSpec) ([]patchOperation, error) {
+// injectionOutcome describes the result of applying a single injection rule to a pod
+type injectionOutcome struct {
+	Technology string
+	Image      string
+	// Failure is the reason the injection could not be completed, empty on success
+	Failure string
+}
 
-	patchOps := []patchOperation{}
+// annotations set on the pod by the instrumentation, see appdInstrumentation, otelInstrumentation
+// and splunkInstrumentation
+var INSTRUMENTATION_VIA_RULE_ANNOTATIONS = []string{
+	"APPD_INSTRUMENTATION_VIA_RULE",
+	"OTEL_INSTRUMENTATION_VIA_RULE",
+	"SPLUNK_INSTRUMENTATION_VIA_RULE",
+}
 
-	containerIdx := 0
+// name prefixes of init containers and containers injected by the instrumentation
+var INSTRUMENTATION_CONTAINER_PREFIXES = []string{
+	"appd-agent-attach-",
+	"otel-agent-attach-",
+	"splunk-agent-attach-",
+	"otel-coll-sidecar",
+	"apache-source-copy",
+	"nginx-source-copy",
+}
+
+// alreadyInstrumented tells whether the pod carries artifacts of a previous instrumentation, which happens
+// when the pod is admitted again or its manifest was copied from an instrumented pod. Returns the reason
+// for logging, empty when the pod is not instrumented.
+func alreadyInstrumented(pod corev1.Pod) string {
+	for _, annotation := range INSTRUMENTATION_VIA_RULE_ANNOTATIONS {
+		if rule, found := pod.Annotations[annotation]; found {
+			return fmt.Sprintf("annotation %s=%s present", annotation, rule)
+		}
+	}
+	containers := append(append([]corev1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...)
+	for _, container := range containers {
+		for _, prefix := range INSTRUMENTATION_CONTAINER_PREFIXES {
+			if strings.HasPrefix(container.Name, prefix) {
+				return fmt.Sprintf("container %s present", container.Name)
+			}
+		}
+	}
+	return ""
+}
+
+// instrument returns the JSON patch instrumenting the pod, computed as the difference between the pod
+// and its instrumented copy
+func instrument(pod corev1.Pod, instrRule *InstrumentationRule) ([]patchOperation, []injectionOutcome, error) {
+	mutatedPod := pod.DeepCopy()
+	outcomes := instrumentPod(mutatedPod, instrRule)
+
+	patchOps, err := createPatch(&pod, mutatedPod)
+	if err != nil {
+		return nil, outcomes, err
+	}
+
+	return patchOps, outcomes, nil
+}
+
+// instrumentPod applies the instrumentation rule to the pod in place. All injection rules are checked
+// before the pod is changed, if any of them cannot be completed, the pod is left uninstrumented and
+// only the failure is recorded in its annotations.
+func instrumentPod(pod *corev1.Pod, rule *InstrumentationRule) []injectionOutcome {
+	outcomes := []injectionOutcome{}
+	// injection rules of a rule set are applied one by one through the spec, so the rule is not changed
+	instrRule := rule.InstrumentationSpec.DeepCopy()
+
+	// container is selected before anything, e.g. a sidecar, gets injected
+	containerIdx := rule.matcher.selectContainer(*pod)
 
 	log.Printf("Using instrumentation rule : %s", instrRule.Name)
 
-	if len(pod.Annotations) == 0 {
+	// If injection rule set defined, all of them are applied to the same pod,
+	// otherwise it's a simple injection rule, one provider, one technology
+	injectionRules := injectionRulesOf(instrRule)
+
+	containerIdxs := [][]int{}
+	failed := false
+	for i := range injectionRules {
+		idxs, outcome := checkInjectionRuleContainers(pod, &injectionRules[i], rule.containerSelector(i), containerIdx)
+		containerIdxs = append(containerIdxs, idxs)
+		outcomes = append(outcomes, outcome)
+		failed = failed || outcome.Failure != ""
+	}
+
+	if failed {
+		for _, outcome := range outcomes {
+			if outcome.Failure != "" {
+				setInstrumentationStatus(pod, "FAILED", outcome.Failure)
+			}
+		}
+		return outcomes
+	}
+
+	for i := range injectionRules {
+		instrRule.InjectionRules = &injectionRules[i]
+		// containers injected by the rule, like the OpenTelemetry collector sidecar, are shared by all of them
+		for _, idx := range containerIdxs[i] {
+			log.Printf("Applying %s to container %s", instrRule.InjectionRules.Technology, pod.Spec.Containers[idx].Name)
+			applyInjectionRule(pod, instrRule, idx)
+		}
+	}
+
+	return outcomes
+}
+
+// createPatch computes the RFC 6902 patch turning the original pod into the mutated one
+func createPatch(original *corev1.Pod, mutated *corev1.Pod) ([]patchOperation, error) {
+	originalBytes, err := json.Marshal(original)
+	if err != nil {
+		return nil, fmt.Errorf("could not serialize pod: %v", err)
+	}
+	mutatedBytes, err := json.Marshal(mutated)
+	if err != nil {
+		return nil, fmt.Errorf("could not serialize instrumented pod: %v", err)
+	}
+
+	operations, err := jsonpatch.CreatePatch(originalBytes, mutatedBytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not create patch: %v", err)
+	}
+
+	patchOps := []patchOperation{}
+	for _, operation := range operations {
 		patchOps = append(patchOps, patchOperation{
-			Op:    "add",
-			Path:  "/metadata/annotations",
-			Value: make(map[string]string),
+			Op:    operation.Operation,
+			Path:  operation.Path,
+			Value: operation.Value,
 		})
 	}
+	return patchOps, nil
+}
 
-	if len(pod.Spec.Containers) > 0 {
-		// fmt.Printf("Container Env: %d -> %v\n", len(pod.Spec.Containers[0].Env), pod.Spec.Containers[0].Env)
-		if len(pod.Spec.Containers[containerIdx].Env) == 0 {
-			patchOps = append(patchOps, patchOperation{
-				Op:    "add",
-				Path:  fmt.Sprintf("/spec/containers/%d/env", containerIdx),
-				Value: []corev1.EnvVar{},
-			})
-		}
-		if len(pod.Spec.Containers[containerIdx].VolumeMounts) == 0 {
-			patchOps = append(patchOps, patchOperation{
-				Op:    "add",
-				Path:  fmt.Sprintf("/spec/containers/%d/volumeMounts", containerIdx),
-				Value: []corev1.VolumeMount{},
-			})
+func injectionTemplateDefined(name string) bool {
+	if config.InjectionTemplates == nil {
+		return false
+	}
+	for _, injTemplate := range *config.InjectionTemplates {
+		if injTemplate.Name == name {
+			return true
 		}
-		if len(pod.Spec.Volumes) == 0 {
-			patchOps = append(patchOps, patchOperation{
-				Op:    "add",
-				Path:  "/spec/volumes/",
-				Value: []corev1.Volume{},
-			})
+	}
+	return false
+}
+
+func injectionFailed(outcomes []injectionOutcome) bool {
+	for _, outcome := range outcomes {
+		if outcome.Failure != "" {
+			return true
 		}
-		if len(pod.Spec.InitContainers) == 0 {
-			patchOps = append(patchOps, patchOperation{
-				Op:    "add",
-				Path:  "/spec/initContainers",
-				Value: []corev1.VolumeMount{},
-			})
+	}
+	return false
+}
+
+// injectionFailures joins the failure reasons of the outcomes
+func injectionFailures(outcomes []injectionOutcome) string {
+	failures := []string{}
+	for _, outcome := range outcomes {
+		if outcome.Failure != "" {
+			failures = append(failures, outcome.Failure)
 		}
 	}
+	return strings.Join(failures, ", ")
+}
 
-	if len(instrRule.InjectionRuleSet) > 0 {
-		// If injection rule set defined, loop over rules
-		// append all together
-		for _, injectionRule := range instrRule.InjectionRuleSet {
-			instrRule.InjectionRules = &injectionRule
-			patchOps = append(patchOps, applyInjectionRule(pod, instrRule)...)
+// checkInjectionRule finds out whether the injection rule could be completed for the pod. Injection itself
+// does its best and leaves out what is missing, so it's run only once all the checks passed.
+func checkInjectionRule(pod *corev1.Pod, injRules *v1alpha1.InjectionRule) injectionOutcome {
+	outcome := injectionOutcome{
+		Technology: injRules.Technology,
+		Image:      injRules.Image,
+	}
 
-			patchOps = removeDupliciteEnvs(patchOps, containerIdx)
+	if injRules.Template != "" && !injectionTemplateDefined(injRules.Template) {
+		outcome.Failure = fmt.Sprintf("Injection template %s not found", injRules.Template)
+		return outcome
+	}
+
+	technology, provider := getTechnologyAndProvider(injRules.Technology)
+	if technologies, found := supportedTechnologies[provider]; !found || !slices.Contains(technologies, technology) {
+		outcome.Failure = "Technology for injection not specified or unknown"
+		return outcome
+	}
+
+	if injRules.OpenTelemetryCollector != "" {
+		if _, _, err := getCollectorConfigsByName(pod.GetNamespace(), injRules.OpenTelemetryCollector); err != nil {
+			outcome.Failure = fmt.Sprintf("OpenTelemetry collector %s not found", injRules.OpenTelemetryCollector)
 		}
-	} else {
-		// It's a simple injection rule, one provider, one technology
-		patchOps = append(patchOps, applyInjectionRule(pod, instrRule)...)
 	}
 
-	return patchOps, nil
+	return outcome
 }
 
-func applyInjectionRule(pod corev1.Pod, instrRule *v1alpha1.InstrumentationSpec) []patchOperation {
-	patchOps := []patchOperation{}
+// checkInjectionRuleContainers selects the containers the injection rule applies to and checks the rule
+// could be completed for the pod, before the pod is changed
+func checkInjectionRuleContainers(pod *corev1.Pod, injRules *v1alpha1.InjectionRule, selector *containerSelector, defaultContainerIdx int) ([]int, injectionOutcome) {
+	outcome := checkInjectionRule(pod, injRules)
+	if outcome.Failure != "" {
+		return nil, outcome
+	}
+	containerIdxs, err := selectContainers(pod, selector, defaultContainerIdx)
+	if err != nil {
+		outcome.Failure = err.Error()
+		return nil, outcome
+	}
+	technology, _ := getTechnologyAndProvider(injRules.Technology)
+	if len(containerIdxs) > 1 && slices.Contains(SINGLE_CONTAINER_TECHNOLOGIES, technology) {
+		outcome.Failure = fmt.Sprintf("%d containers selected, %s can be injected into a single container only", len(containerIdxs), technology)
+		return nil, outcome
+	}
+	return containerIdxs, outcome
+}
 
+func applyInjectionRule(pod *corev1.Pod, instrRule *v1alpha1.InstrumentationSpec, containerIdx int) {
 	_, provider := getTechnologyAndProvider(instrRule.InjectionRules.Technology)
 
 	switch provider {
 	case "appd":
-		patchOps = append(patchOps, appdInstrumentation(pod, instrRule)...)
+		appdInstrumentation(pod, instrRule, containerIdx)
 	case "otel":
-		patchOps = append(patchOps, otelInstrumentation(pod, instrRule)...)
+		otelInstrumentation(pod, instrRule, containerIdx)
 	case "splunk":
-		patchOps = append(patchOps, splunkInstrumentation(pod, instrRule)...)
+		splunkInstrumentation(pod, instrRule, containerIdx)
 	}
-
-	return patchOps
 }
 
-func appdInstrumentation(pod corev1.Pod, instrRule *v1alpha1.InstrumentationSpec) []patchOperation {
-
-	patchOps := []patchOperation{}
-
-	patchOps = append(patchOps, patchOperation{
-		Op:    "add",
-		Path:  "/metadata/annotations/APPD_INSTRUMENTATION_VIA_RULE",
-		Value: string(instrRule.Name),
-	})
+func appdInstrumentation(pod *corev1.Pod, instrRule *v1alpha1.InstrumentationSpec, containerIdx int) {
+	setAnnotation(pod, "APPD_INSTRUMENTATION_VIA_RULE", string(instrRule.Name))
 
 	technology, _ := getTechnologyAndProvider(instrRule.InjectionRules.Technology)
 
 	switch technology {
 	case "java":
-		patchOps = append(patchOps, javaAppdInstrumentation(pod, instrRule)...)
+		javaAppdInstrumentation(pod, instrRule, containerIdx)
 	case "dotnetcore":
-		patchOps = append(patchOps, dotnetAppdInstrumentation(pod, instrRule)...)
+		dotnetAppdInstrumentation(pod, instrRule, containerIdx)
 	case "nodejs":
-		patchOps = append(patchOps, nodejsAppdInstrumentation(pod, instrRule)...)
+		nodejsAppdInstrumentation(pod, instrRule, containerIdx)
 	case "apache":
-		patchOps = append(patchOps, apacheAppdInstrumentation(pod, instrRule)...)
+		apacheAppdInstrumentation(pod, instrRule, containerIdx)
 	default:
-		patchOps = append(patchOps, getInstrumentationStatusPatch("FAILED", "Technology for injection not specified or unknown")...)
+		// reported as failure by checkInjectionRule
 	}
-
-	return patchOps
 }
 
-func otelInstrumentation(pod corev1.Pod, instrRule *v1alpha1.InstrumentationSpec) []patchOperation {
-
-	patchOps := []patchOperation{}
-
-	patchOps = append(patchOps, patchOperation{
-		Op:    "add",
-		Path:  "/metadata/annotations/OTEL_INSTRUMENTATION_VIA_RULE",
-		Value: string(instrRule.Name),
-	})
+func otelInstrumentation(pod *corev1.Pod, instrRule *v1alpha1.InstrumentationSpec, containerIdx int) {
+	setAnnotation(pod, "OTEL_INSTRUMENTATION_VIA_RULE", string(instrRule.Name))
 
 	technology, _ := getTechnologyAndProvider(instrRule.InjectionRules.Technology)
 
 	switch technology {
 	case "java":
-		patchOps = append(patchOps, javaOtelInstrumentation(pod, instrRule)...)
+		javaOtelInstrumentation(pod, instrRule, containerIdx)
 	case "dotnetcore":
-		patchOps = append(patchOps, dotnetOtelInstrumentation(pod, instrRule)...)
+		dotnetOtelInstrumentation(pod, instrRule, containerIdx)
 	case "nodejs":
-		patchOps = append(patchOps, nodejsOtelInstrumentation(pod, instrRule)...)
+		nodejsOtelInstrumentation(pod, instrRule, containerIdx)
 	case "apache":
-		patchOps = append(patchOps, apacheOtelInstrumentation(pod, instrRule)...)
+		apacheOtelInstrumentation(pod, instrRule, containerIdx)
 	case "nginx":
-		patchOps = append(patchOps, nginxOtelInstrumentation(pod, instrRule)...)
+		nginxOtelInstrumentation(pod, instrRule, containerIdx)
 	default:
-		patchOps = append(patchOps, getInstrumentationStatusPatch("FAILED", "Technology for injection not specified or unknown")...)
+		// reported as failure by checkInjectionRule
 	}
-
-	return patchOps
 }
 
-func splunkInstrumentation(pod corev1.Pod, instrRule *v1alpha1.InstrumentationSpec) []patchOperation {
-
-	patchOps := []patchOperation{}
-
-	patchOps = append(patchOps, patchOperation{
-		Op:    "add",
-		Path:  "/metadata/annotations/SPLUNK_INSTRUMENTATION_VIA_RULE",
-		Value: string(instrRule.Name),
-	})
+func splunkInstrumentation(pod *corev1.Pod, instrRule *v1alpha1.InstrumentationSpec, containerIdx int) {
+	setAnnotation(pod, "SPLUNK_INSTRUMENTATION_VIA_RULE", string(instrRule.Name))
 
 	technology, _ := getTechnologyAndProvider(instrRule.InjectionRules.Technology)
 
 	switch technology {
 	case "java":
-		patchOps = append(patchOps, javaSplunkInstrumentation(pod, instrRule)...)
+		javaSplunkInstrumentation(pod, instrRule, containerIdx)
 	case "dotnetcore":
-		// patchOps = append(patchOps, dotnetSplunkInstrumentation(pod, instrRule)...)
+		// dotnetSplunkInstrumentation(pod, instrRule)
 	case "nodejs":
-		// patchOps = append(patchOps, nodejsSplunkInstrumentation(pod, instrRule)...)
+		// nodejsSplunkInstrumentation(pod, instrRule)
 	default:
-		patchOps = append(patchOps, getInstrumentationStatusPatch("FAILED", "Technology for injection not specified or unknown")...)
+		// reported as failure by checkInjectionRule
 	}
-
-	return patchOps
 }
 
-func getApplicationName(pod corev1.Pod, instrRule *v1alpha1.InstrumentationSpec) string {
+func getApplicationName(pod *corev1.Pod, instrRule *v1alpha1.InstrumentationSpec) string {
 	appName := ""
 	injRules := instrRule.InjectionRules
 	switch injRules.ApplicationNameSource {
@@ -264,7 +385,7 @@ func getApplicationName(pod corev1.Pod, instrRule *v1alpha1.InstrumentationSpec)
 	return appName
 }
 
-func getTierName(pod corev1.Pod, instrRule *v1alpha1.InstrumentationSpec) string {
+func getTierName(pod *corev1.Pod, instrRule *v1alpha1.InstrumentationSpec) string {
 	tierName := ""
 	injRules := instrRule.InjectionRules
 	switch injRules.TierNameSource {
@@ -295,7 +416,7 @@ func getTierName(pod corev1.Pod, instrRule *v1alpha1.InstrumentationSpec) string
 	return tierName
 }
 
-func getSplunkDeploymentEnvironment(pod corev1.Pod, instrRule *v1alpha1.InstrumentationSpec) string {
+func getSplunkDeploymentEnvironment(pod *corev1.Pod, instrRule *v1alpha1.InstrumentationSpec) string {
 	dEnvName := ""
 	injRules := instrRule.InjectionRules.SplunkConfig
 	switch injRules.DeploymentEnvironmentNameSource {
@@ -355,7 +476,7 @@ func getSplunkDeploymentEnvironment(pod corev1.Pod, instrRule *v1alpha1.Instrume
 	return dEnvName
 }
 
-func getSplunkClusterName(_ corev1.Pod, instrRule *v1alpha1.InstrumentationSpec) string {
+func getSplunkClusterName(_ *corev1.Pod, instrRule *v1alpha1.InstrumentationSpec) string {
 	clusterName := ""
 	injRules := instrRule.InjectionRules.SplunkConfig
 
@@ -368,55 +489,129 @@ func getSplunkClusterName(_ corev1.Pod, instrRule *v1alpha1.InstrumentationSpec)
 	return clusterName
 }
 
-func getInstrumentationStatusPatch(status string, reason string) []patchOperation {
-	patchOps := []patchOperation{}
-
-	patchOps = append(patchOps, patchOperation{
-		Op:    "add",
-		Path:  "/metadata/annotations/APPD_INSTRUMENTATION_STATUS",
-		Value: status,
-	})
+func setInstrumentationStatus(pod *corev1.Pod, status string, reason string) {
+	setAnnotation(pod, "APPD_INSTRUMENTATION_STATUS", status)
 	if reason != "" {
-		patchOps = append(patchOps, patchOperation{
-			Op:    "add",
-			Path:  "/metadata/annotations/APPD_INSTRUMENTATION_FAILURE_REASON",
-			Value: reason,
-		})
+		setAnnotation(pod, "APPD_INSTRUMENTATION_FAILURE_REASON", reason)
 	}
+}
 
-	return patchOps
+func setAnnotation(pod *corev1.Pod, key string, value string) {
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	pod.Annotations[key] = value
 }
 
-func addContainerEnvVar(name string, value string, containerIdx int) patchOperation {
-	return patchOperation{
-		Op:   "add",
-		Path: fmt.Sprintf("/spec/containers/%d/env/-", containerIdx),
-		Value: corev1.EnvVar{
-			Name:  name,
-			Value: value,
-		},
+// addContainerEnv sets the env var of the container. An env var of the same name is replaced in place,
+// so that applying several injection rules does not duplicate env vars.
+func addContainerEnv(pod *corev1.Pod, containerIdx int, envVar corev1.EnvVar) {
+	container := &pod.Spec.Containers[containerIdx]
+	for idx := range container.Env {
+		if container.Env[idx].Name == envVar.Name {
+			container.Env[idx] = envVar
+			return
+		}
 	}
+	container.Env = append(container.Env, envVar)
 }
 
-func addSpecifiedContainerEnvVars(vars []v1alpha1.NameValue, containerIdx int) []patchOperation {
-	patchOps := []patchOperation{}
+func removeContainerEnv(pod *corev1.Pod, containerIdx int, name string) {
+	container := &pod.Spec.Containers[containerIdx]
+	for idx := range container.Env {
+		if container.Env[idx].Name == name {
+			container.Env = append(container.Env[:idx], container.Env[idx+1:]...)
+			return
+		}
+	}
+}
 
+func addContainerEnvVar(pod *corev1.Pod, name string, value string, containerIdx int) {
+	addContainerEnv(pod, containerIdx, corev1.EnvVar{
+		Name:  name,
+		Value: value,
+	})
+}
+
+func addSpecifiedContainerEnvVars(pod *corev1.Pod, vars []v1alpha1.NameValue, containerIdx int) {
 	for _, envvar := range vars {
-		patchOps = append(patchOps, patchOperation{
-			Op:   "add",
-			Path: fmt.Sprintf("/spec/containers/%d/env/-", containerIdx),
-			Value: corev1.EnvVar{
-				Name:  envvar.Name,
-				Value: envvar.Value,
-			},
-		})
+		addContainerEnvVar(pod, envvar.Name, envvar.Value, containerIdx)
 	}
-	return patchOps
 }
 
-func addK8SOtelResourceAttrs(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerIdx int, envVarName string) []patchOperation {
-	patchOps := []patchOperation{}
+// addContainerVolumeMount mounts the volume into the container, replacing a mount of the same path
+func addContainerVolumeMount(pod *corev1.Pod, containerIdx int, volumeMount corev1.VolumeMount) {
+	container := &pod.Spec.Containers[containerIdx]
+	for idx := range container.VolumeMounts {
+		if container.VolumeMounts[idx].MountPath == volumeMount.MountPath {
+			container.VolumeMounts[idx] = volumeMount
+			return
+		}
+	}
+	container.VolumeMounts = append(container.VolumeMounts, volumeMount)
+}
+
+// addVolume adds the volume to the pod, replacing a volume of the same name
+func addVolume(pod *corev1.Pod, volume corev1.Volume) {
+	for idx := range pod.Spec.Volumes {
+		if pod.Spec.Volumes[idx].Name == volume.Name {
+			pod.Spec.Volumes[idx] = volume
+			return
+		}
+	}
+	pod.Spec.Volumes = append(pod.Spec.Volumes, volume)
+}
 
+// addInitContainer adds the init container to the pod, replacing an init container of the same name
+func addInitContainer(pod *corev1.Pod, container corev1.Container) {
+	for idx := range pod.Spec.InitContainers {
+		if pod.Spec.InitContainers[idx].Name == container.Name {
+			pod.Spec.InitContainers[idx] = container
+			return
+		}
+	}
+	pod.Spec.InitContainers = append(pod.Spec.InitContainers, container)
+}
+
+// addContainer adds the container to the pod, replacing a container of the same name
+func addContainer(pod *corev1.Pod, container corev1.Container) {
+	for idx := range pod.Spec.Containers {
+		if pod.Spec.Containers[idx].Name == container.Name {
+			pod.Spec.Containers[idx] = container
+			return
+		}
+	}
+	pod.Spec.Containers = append(pod.Spec.Containers, container)
+}
+
+// resource attributes set by addK8SOtelResourceAttrs, replaced when already present
+var K8S_OTEL_RESOURCE_ATTRS = []string{
+	"k8s.pod.ip",
+	"k8s.pod.name",
+	"k8s.pod.uid",
+	"k8s.namespace.name",
+	"k8s.container.name",
+	"k8s.container.restart_count",
+	"deployment.environment",
+	"k8s.cluster.name",
+}
+
+// dropOtelResourceAttrs removes the given keys from a comma separated list of key=value resource attributes
+func dropOtelResourceAttrs(otelResourceAttributes string, keys []string) string {
+	if otelResourceAttributes == "" {
+		return ""
+	}
+	kept := []string{}
+	for _, attribute := range strings.Split(otelResourceAttributes, ",") {
+		key, _, _ := strings.Cut(attribute, "=")
+		if !slices.Contains(keys, strings.TrimSpace(key)) {
+			kept = append(kept, attribute)
+		}
+	}
+	return strings.Join(kept, ",")
+}
+
+func addK8SOtelResourceAttrs(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerIdx int, envVarName string) {
 	if envVarName == "" {
 		envVarName = "OTEL_RESOURCE_ATTRIBUTES"
 	}
@@ -433,54 +628,38 @@ func addK8SOtelResourceAttrs(pod corev1.Pod, instrRules *v1alpha1.Instrumentatio
 	}
 
 	if *instrRules.InjectionRules.InjectK8SOtelResourceAttrs {
-		patchOps = append(patchOps, patchOperation{
-			Op:   "add",
-			Path: fmt.Sprintf("/spec/containers/%d/env/-", containerIdx),
-			Value: corev1.EnvVar{
-				Name: "K8S_POD_IP",
-				ValueFrom: &corev1.EnvVarSource{
-					FieldRef: &corev1.ObjectFieldSelector{
-						FieldPath: "status.podIP",
-					},
+		addContainerEnv(pod, containerIdx, corev1.EnvVar{
+			Name: "K8S_POD_IP",
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{
+					FieldPath: "status.podIP",
 				},
 			},
 		})
 
-		patchOps = append(patchOps, patchOperation{
-			Op:   "add",
-			Path: fmt.Sprintf("/spec/containers/%d/env/-", containerIdx),
-			Value: corev1.EnvVar{
-				Name: "K8S_POD_NAME",
-				ValueFrom: &corev1.EnvVarSource{
-					FieldRef: &corev1.ObjectFieldSelector{
-						FieldPath: "metadata.name",
-					},
+		addContainerEnv(pod, containerIdx, corev1.EnvVar{
+			Name: "K8S_POD_NAME",
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{
+					FieldPath: "metadata.name",
 				},
 			},
 		})
 
-		patchOps = append(patchOps, patchOperation{
-			Op:   "add",
-			Path: fmt.Sprintf("/spec/containers/%d/env/-", containerIdx),
-			Value: corev1.EnvVar{
-				Name: "K8S_POD_UID",
-				ValueFrom: &corev1.EnvVarSource{
-					FieldRef: &corev1.ObjectFieldSelector{
-						FieldPath: "metadata.uid",
-					},
+		addContainerEnv(pod, containerIdx, corev1.EnvVar{
+			Name: "K8S_POD_UID",
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{
+					FieldPath: "metadata.uid",
 				},
 			},
 		})
 
-		patchOps = append(patchOps, patchOperation{
-			Op:   "add",
-			Path: fmt.Sprintf("/spec/containers/%d/env/-", containerIdx),
-			Value: corev1.EnvVar{
-				Name: "K8S_NAMESPACE_NAME",
-				ValueFrom: &corev1.EnvVarSource{
-					FieldRef: &corev1.ObjectFieldSelector{
-						FieldPath: "metadata.namespace",
-					},
+		addContainerEnv(pod, containerIdx, corev1.EnvVar{
+			Name: "K8S_NAMESPACE_NAME",
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{
+					FieldPath: "metadata.namespace",
 				},
 			},
 		})
@@ -496,81 +675,59 @@ func addK8SOtelResourceAttrs(pod corev1.Pod, instrRules *v1alpha1.Instrumentatio
 				",k8s.cluster.name=" + getSplunkClusterName(pod, instrRules)
 		}
 
-		if preSetOtelResAttrs != "" {
+		if preSetOtelResAttrs = dropOtelResourceAttrs(preSetOtelResAttrs, K8S_OTEL_RESOURCE_ATTRS); preSetOtelResAttrs != "" {
 			otelResourceAttributes = preSetOtelResAttrs + "," + otelResourceAttributes
 		}
 
-		patchOps = append(patchOps, patchOperation{
-			Op:   "add",
-			Path: fmt.Sprintf("/spec/containers/%d/env/-", containerIdx),
-			Value: corev1.EnvVar{
-				Name:  envVarName,
-				Value: otelResourceAttributes,
-			},
+		// the attributes reference the K8S_* env vars, so they have to be defined after them
+		removeContainerEnv(pod, containerIdx, envVarName)
+		addContainerEnv(pod, containerIdx, corev1.EnvVar{
+			Name:  envVarName,
+			Value: otelResourceAttributes,
 		})
 	}
 
-	log.Printf("OTelRsrs: %t, %v\n", *instrRules.InjectionRules.InjectK8SOtelResourceAttrs, patchOps)
-
-	return patchOps
+	log.Printf("OTelRsrs: %t, %v\n", *instrRules.InjectionRules.InjectK8SOtelResourceAttrs, pod.Spec.Containers[containerIdx].Env)
 }
 
-func addNetvizEnvVars(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerIdx int) []patchOperation {
-	patchOps := []patchOperation{}
-
-	patchOps = append(patchOps, patchOperation{
-		Op:   "add",
-		Path: fmt.Sprintf("/spec/containers/%d/env/-", containerIdx),
-		Value: corev1.EnvVar{
-			Name: "APPDYNAMICS_NETVIZ_AGENT_HOST",
-			ValueFrom: &corev1.EnvVarSource{
-				FieldRef: &corev1.ObjectFieldSelector{
-					APIVersion: "v1",
-					FieldPath:  "status.hostIP",
-				},
+func addNetvizEnvVars(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerIdx int) {
+	addContainerEnv(pod, containerIdx, corev1.EnvVar{
+		Name: "APPDYNAMICS_NETVIZ_AGENT_HOST",
+		ValueFrom: &corev1.EnvVarSource{
+			FieldRef: &corev1.ObjectFieldSelector{
+				APIVersion: "v1",
+				FieldPath:  "status.hostIP",
 			},
 		},
 	})
-	patchOps = append(patchOps, addContainerEnvVar("APPDYNAMICS_NETVIZ_AGENT_PORT", instrRules.InjectionRules.NetvizPort, 0))
-
-	return patchOps
+	addContainerEnvVar(pod, "APPDYNAMICS_NETVIZ_AGENT_PORT", instrRules.InjectionRules.NetvizPort, containerIdx)
 }
 
-func addControllerEnvVars(containerIdx int) []patchOperation {
-	patchOps := []patchOperation{}
-
+func addControllerEnvVars(pod *corev1.Pod, containerIdx int) {
 	// this assumes secret exists in a given namespace, at this time, it's not ensured by the
 	// webhook!
 	if config.ControllerConfig.AccessKeySecret != "" {
-		patchOps = append(patchOps, patchOperation{
-			Op:   "add",
-			Path: fmt.Sprintf("/spec/containers/%d/env/-", containerIdx),
-			Value: corev1.EnvVar{
-				Name: "APPDYNAMICS_AGENT_ACCOUNT_ACCESS_KEY",
-				ValueFrom: &corev1.EnvVarSource{
-					SecretKeyRef: &corev1.SecretKeySelector{
-						Key: config.ControllerConfig.AccessKeySecretKey,
-						LocalObjectReference: corev1.LocalObjectReference{
-							Name: config.ControllerConfig.AccessKeySecret,
-						},
+		addContainerEnv(pod, containerIdx, corev1.EnvVar{
+			Name: "APPDYNAMICS_AGENT_ACCOUNT_ACCESS_KEY",
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					Key: config.ControllerConfig.AccessKeySecretKey,
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: config.ControllerConfig.AccessKeySecret,
 					},
 				},
 			},
 		})
 	} else {
-		patchOps = append(patchOps, addContainerEnvVar("APPDYNAMICS_AGENT_ACCOUNT_ACCESS_KEY", config.ControllerConfig.AccessKey, 0))
+		addContainerEnvVar(pod, "APPDYNAMICS_AGENT_ACCOUNT_ACCESS_KEY", config.ControllerConfig.AccessKey, containerIdx)
 	}
-	patchOps = append(patchOps, addContainerEnvVar("APPDYNAMICS_CONTROLLER_HOST_NAME", config.ControllerConfig.Host, 0))
-	patchOps = append(patchOps, addContainerEnvVar("APPDYNAMICS_CONTROLLER_PORT", config.ControllerConfig.Port, 0))
-	patchOps = append(patchOps, addContainerEnvVar("APPDYNAMICS_CONTROLLER_SSL_ENABLED", strconv.FormatBool(config.ControllerConfig.IsSecure), 0))
-	patchOps = append(patchOps, addContainerEnvVar("APPDYNAMICS_AGENT_ACCOUNT_NAME", config.ControllerConfig.AccountName, 0))
-
-	return patchOps
+	addContainerEnvVar(pod, "APPDYNAMICS_CONTROLLER_HOST_NAME", config.ControllerConfig.Host, containerIdx)
+	addContainerEnvVar(pod, "APPDYNAMICS_CONTROLLER_PORT", config.ControllerConfig.Port, containerIdx)
+	addContainerEnvVar(pod, "APPDYNAMICS_CONTROLLER_SSL_ENABLED", strconv.FormatBool(config.ControllerConfig.IsSecure), containerIdx)
+	addContainerEnvVar(pod, "APPDYNAMICS_AGENT_ACCOUNT_NAME", config.ControllerConfig.AccountName, containerIdx)
 }
 
-func addTemplate(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerIdx int) []patchOperation {
-	patchOps := []patchOperation{}
-	return patchOps
+func addTemplate(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerIdx int) {
 }
 
 func reuseNodeNames(instrRules *v1alpha1.InstrumentationSpec) bool {
@@ -594,39 +751,3 @@ func getTechnologyAndProvider(technologyString string) (string, string) {
 	}
 	return technology, provider
 }
-
-func removeDupliciteEnvs(patchOps []patchOperation, containerIdx int) []patchOperation {
-
-	newPatchOps := []patchOperation{}
-
-	envMap := map[string]int{}
-
-	for idx, po := range patchOps {
-		if po.Path == fmt.Sprintf("/spec/containers/%d/env/-", containerIdx) {
-			env, ok := po.Value.(corev1.EnvVar)
-			if !ok {
-				continue
-			}
-			envMap[env.Name] = idx
-		}
-	}
-
-	log.Printf("Env Map: %v\n", envMap)
-
-	for idx, po := range patchOps {
-		if po.Path != fmt.Sprintf("/spec/containers/%d/env/-", containerIdx) {
-			newPatchOps = append(newPatchOps, po)
-		} else {
-			env, ok := po.Value.(corev1.EnvVar)
-			if !ok { // should not ever happen, but just to be sure...
-				newPatchOps = append(newPatchOps, po)
-				continue
-			}
-			if envMap[env.Name] == idx { //this is the last occurence, use it
-				newPatchOps = append(newPatchOps, po)
-			}
-		}
-	}
-
-	return newPatchOps
-}
@@ -22,8 +22,5 @@ import (
 	corev1 "k8s.io/api/core/v1"
 )
 
-func apacheAppdInstrumentation(pod corev1.Pod, instrRule *v1alpha1.InstrumentationSpec) []patchOperation {
-	patchOps := []patchOperation{}
-
-	return patchOps
+func apacheAppdInstrumentation(pod *corev1.Pod, instrRule *v1alpha1.InstrumentationSpec, containerIdx int) {
 }
@@ -25,159 +25,125 @@ import (
 	"k8s.io/apimachinery/pkg/api/resource"
 )
 
-func dotnetAppdInstrumentation(pod corev1.Pod, instrRule *v1alpha1.InstrumentationSpec) []patchOperation {
-	patchOps := []patchOperation{}
-
-	patchOps = append(patchOps, addControllerEnvVars(0)...)
-	patchOps = append(patchOps, addDotnetEnvVar(pod, instrRule, 0)...)
-	patchOps = append(patchOps, addDotnetOtelEnvVar(pod, instrRule, 0)...)
-	patchOps = append(patchOps, addContainerEnvVar("APPDYNAMICS_AGENT_APPLICATION_NAME", getApplicationName(pod, instrRule), 0))
-	patchOps = append(patchOps, addContainerEnvVar("APPDYNAMICS_AGENT_TIER_NAME", getTierName(pod, instrRule), 0))
+func dotnetAppdInstrumentation(pod *corev1.Pod, instrRule *v1alpha1.InstrumentationSpec, containerIdx int) {
+	addControllerEnvVars(pod, containerIdx)
+	addDotnetEnvVar(pod, instrRule, containerIdx)
+	addDotnetOtelEnvVar(pod, instrRule, containerIdx)
+	addContainerEnvVar(pod, "APPDYNAMICS_AGENT_APPLICATION_NAME", getApplicationName(pod, instrRule), containerIdx)
+	addContainerEnvVar(pod, "APPDYNAMICS_AGENT_TIER_NAME", getTierName(pod, instrRule), containerIdx)
 	if reuseNodeNames(instrRule) {
-		patchOps = append(patchOps, addContainerEnvVar("APPDYNAMICS_AGENT_REUSE_NODE_NAME_PREFIX", getTierName(pod, instrRule), 0))
+		addContainerEnvVar(pod, "APPDYNAMICS_AGENT_REUSE_NODE_NAME_PREFIX", getTierName(pod, instrRule), containerIdx)
 	}
 
-	patchOps = append(patchOps, addSpecifiedContainerEnvVars(instrRule.InjectionRules.EnvVars, 0)...)
+	addSpecifiedContainerEnvVars(pod, instrRule.InjectionRules.EnvVars, containerIdx)
 
-	patchOps = append(patchOps, addNetvizEnvVars(pod, instrRule, 0)...)
+	addNetvizEnvVars(pod, instrRule, containerIdx)
 
-	patchOps = append(patchOps, addDotnetAgentVolumeMount(pod, instrRule, 0)...)
+	addDotnetAgentVolumeMount(pod, instrRule, containerIdx)
 
-	patchOps = append(patchOps, addDotnetAgentInitContainer(pod, instrRule)...)
+	addDotnetAgentInitContainer(pod, instrRule)
 
-	patchOps = append(patchOps, addDotnetAgentVolume(pod, instrRule)...)
-
-	return patchOps
+	addDotnetAgentVolume(pod, instrRule)
 }
 
-func addDotnetEnvVar(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerIdx int) []patchOperation {
-	patchOps := []patchOperation{}
-
-	patchOps = append(patchOps, addContainerEnvVar("LD_LIBRARY_PATH", "/opt/appdynamics-dotnetcore", 0))
-	patchOps = append(patchOps, addContainerEnvVar("CORECLR_PROFILER", "{57e1aa68-2229-41aa-9931-a6e93bbc64d8}", 0))
-	patchOps = append(patchOps, addContainerEnvVar("CORECLR_PROFILER_PATH", "/opt/appdynamics-dotnetcore/libappdprofiler.so", 0))
-	patchOps = append(patchOps, addContainerEnvVar("CORECLR_ENABLE_PROFILING", "1", 0))
+func addDotnetEnvVar(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerIdx int) {
+	addContainerEnvVar(pod, "LD_LIBRARY_PATH", "/opt/appdynamics-dotnetcore", containerIdx)
+	addContainerEnvVar(pod, "CORECLR_PROFILER", "{57e1aa68-2229-41aa-9931-a6e93bbc64d8}", containerIdx)
+	addContainerEnvVar(pod, "CORECLR_PROFILER_PATH", "/opt/appdynamics-dotnetcore/libappdprofiler.so", containerIdx)
+	addContainerEnvVar(pod, "CORECLR_ENABLE_PROFILING", "1", containerIdx)
 	if reuseNodeNames(instrRules) {
-		patchOps = append(patchOps, addContainerEnvVar("APPDYNAMICS_AGENT_REUSE_NODE_NAME", "true", 0))
+		addContainerEnvVar(pod, "APPDYNAMICS_AGENT_REUSE_NODE_NAME", "true", containerIdx)
 	} else {
-		patchOps = append(patchOps, patchOperation{
-			Op:   "add",
-			Path: fmt.Sprintf("/spec/containers/%d/env/-", containerIdx),
-			Value: corev1.EnvVar{
-				Name: "APPDYNAMICS_AGENT_NODE_NAME",
-				ValueFrom: &corev1.EnvVarSource{
-					FieldRef: &corev1.ObjectFieldSelector{
-						APIVersion: "v1",
-						FieldPath:  "metadata.name",
-					},
+		addContainerEnv(pod, containerIdx, corev1.EnvVar{
+			Name: "APPDYNAMICS_AGENT_NODE_NAME",
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{
+					APIVersion: "v1",
+					FieldPath:  "metadata.name",
 				},
 			},
 		})
 	}
 
 	if config.ControllerConfig.UseProxy {
-		patchOps = append(patchOps, addContainerEnvVar("APPDYNAMICS_PROXY_HOST_NAME", config.ControllerConfig.ProxyHost, 0))
-		patchOps = append(patchOps, addContainerEnvVar("APPDYNAMICS_PROXY_PORT", config.ControllerConfig.ProxyPort, 0))
+		addContainerEnvVar(pod, "APPDYNAMICS_PROXY_HOST_NAME", config.ControllerConfig.ProxyHost, containerIdx)
+		addContainerEnvVar(pod, "APPDYNAMICS_PROXY_PORT", config.ControllerConfig.ProxyPort, containerIdx)
 		if config.ControllerConfig.ProxyUser != "" {
-			patchOps = append(patchOps, addContainerEnvVar("APPDYNAMICS_PROXY_AUTH_NAME", config.ControllerConfig.ProxyUser, 0))
-			patchOps = append(patchOps, addContainerEnvVar("APPDYNAMICS_PROXY_AUTH_PASSWORD", config.ControllerConfig.ProxyPassword, 0))
+			addContainerEnvVar(pod, "APPDYNAMICS_PROXY_AUTH_NAME", config.ControllerConfig.ProxyUser, containerIdx)
+			addContainerEnvVar(pod, "APPDYNAMICS_PROXY_AUTH_PASSWORD", config.ControllerConfig.ProxyPassword, containerIdx)
 		}
 		if config.ControllerConfig.ProxyDomain != "" {
-			patchOps = append(patchOps, addContainerEnvVar("APPDYNAMICS_PROXY_AUTH_DOMAIN", config.ControllerConfig.ProxyDomain, 0))
+			addContainerEnvVar(pod, "APPDYNAMICS_PROXY_AUTH_DOMAIN", config.ControllerConfig.ProxyDomain, containerIdx)
 		}
 	}
-
-	return patchOps
 }
 
-func addDotnetOtelEnvVar(pod corev1.Pod, instrRule *v1alpha1.InstrumentationSpec, containerIdx int) []patchOperation {
-	patchOps := []patchOperation{}
+func addDotnetOtelEnvVar(pod *corev1.Pod, instrRule *v1alpha1.InstrumentationSpec, containerIdx int) {
 	if instrRule.InjectionRules.OpenTelemetryCollector != "" {
 		otelCollConfig, _, err := getCollectorConfigsByName(pod.GetNamespace(), instrRule.InjectionRules.OpenTelemetryCollector)
 		// otelCollConfig, found := otelCollsConfig[instrRule.InjectionRules.OpenTelemetryCollector]
 		if err != nil {
 			log.Printf("Cannot find OTel collector definition %s\n", instrRule.InjectionRules.OpenTelemetryCollector)
 		} else {
-
-			patchOps = append(patchOps, addContainerEnvVar("APPDYNAMICS_OPENTELEMETRY_ENABLED", "true", containerIdx))
-			patchOps = append(patchOps, addContainerEnvVar("OTEL_TRACES_EXPORTER", "otlp", containerIdx))
+			addContainerEnvVar(pod, "APPDYNAMICS_OPENTELEMETRY_ENABLED", "true", containerIdx)
+			addContainerEnvVar(pod, "OTEL_TRACES_EXPORTER", "otlp", containerIdx)
 			otelRsrcAttrs := ""
 			if *instrRule.InjectionRules.InjectK8SOtelResourceAttrs {
-				patchOps = append(patchOps, addK8SOtelResourceAttrs(pod, instrRule, containerIdx, "OTEL_RESOURCE_ATTRIBUTES_K8S")...)
+				addK8SOtelResourceAttrs(pod, instrRule, containerIdx, "OTEL_RESOURCE_ATTRIBUTES_K8S")
 				otelRsrcAttrs = ",$(OTEL_RESOURCE_ATTRIBUTES_K8S)"
 			}
 			resourceAttributes := fmt.Sprintf("service.name=%s,service.namespace=%s%s", getTierName(pod, instrRule), getApplicationName(pod, instrRule), otelRsrcAttrs)
-			patchOps = append(patchOps, addContainerEnvVar("OTEL_RESOURCE_ATTRIBUTES", resourceAttributes, containerIdx))
+			addContainerEnvVar(pod, "OTEL_RESOURCE_ATTRIBUTES", resourceAttributes, containerIdx)
 			if otelCollConfig.Mode == "sidecar" {
-				patchOps = append(patchOps, addContainerEnvVar("OTEL_EXPORTER_OTLP_ENDPOINT", "http://localhost:4318", containerIdx))
-				patchOps = append(patchOps, addOtelCollSidecar(pod, instrRule, containerIdx)...)
+				addContainerEnvVar(pod, "OTEL_EXPORTER_OTLP_ENDPOINT", "http://localhost:4318", containerIdx)
+				addOtelCollSidecar(pod, instrRule, containerIdx)
 			} else if (otelCollConfig.Mode == "deployment") || (otelCollConfig.Mode == "external") {
-				patchOps = append(patchOps, addContainerEnvVar("OTEL_EXPORTER_OTLP_ENDPOINT", fmt.Sprintf("http://%s:4318", otelCollConfig.ServiceName), containerIdx))
+				addContainerEnvVar(pod, "OTEL_EXPORTER_OTLP_ENDPOINT", fmt.Sprintf("http://%s:4318", otelCollConfig.ServiceName), containerIdx)
 			}
 		}
 	}
-
-	return patchOps
 }
 
-func addDotnetAgentVolumeMount(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerIdx int) []patchOperation {
-	patchOps := []patchOperation{}
-	patchOps = append(patchOps, patchOperation{
-		Op:   "add",
-		Path: fmt.Sprintf("/spec/containers/%d/volumeMounts/-", containerIdx),
-		Value: corev1.VolumeMount{
-			MountPath: "/opt/appdynamics-dotnetcore", //TODO
-			Name:      "appd-agent-repo-dotnetcore",  //TODO
-		},
+func addDotnetAgentVolumeMount(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerIdx int) {
+	addContainerVolumeMount(pod, containerIdx, corev1.VolumeMount{
+		MountPath: "/opt/appdynamics-dotnetcore", //TODO
+		Name:      "appd-agent-repo-dotnetcore",  //TODO
 	})
-	return patchOps
 }
 
-func addDotnetAgentVolume(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) []patchOperation {
-	patchOps := []patchOperation{}
-	patchOps = append(patchOps, patchOperation{
-		Op:   "add",
-		Path: "/spec/volumes/-",
-		Value: corev1.Volume{
-			Name: "appd-agent-repo-dotnetcore", //TODO
-			VolumeSource: corev1.VolumeSource{
-				EmptyDir: &corev1.EmptyDirVolumeSource{},
-			},
+func addDotnetAgentVolume(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) {
+	addVolume(pod, corev1.Volume{
+		Name: "appd-agent-repo-dotnetcore", //TODO
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{},
 		},
 	})
-	return patchOps
 }
 
-func addDotnetAgentInitContainer(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) []patchOperation {
-	patchOps := []patchOperation{}
+func addDotnetAgentInitContainer(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) {
 	limCPU, _ := resource.ParseQuantity("200m")
 	limMem, _ := resource.ParseQuantity("75M")
 	reqCPU, _ := resource.ParseQuantity(instrRules.InjectionRules.ResourceReservation.CPU)
 	reqMem, _ := resource.ParseQuantity(instrRules.InjectionRules.ResourceReservation.Memory)
 
-	patchOps = append(patchOps, patchOperation{
-		Op:   "add",
-		Path: "/spec/initContainers/-",
-		Value: corev1.Container{
-			Name:            "appd-agent-attach-dotnetcore", //TODO
-			Image:           instrRules.InjectionRules.Image,
-			Command:         []string{"cp", "-r", "/opt/appdynamics/.", "/opt/appdynamics-dotnetcore"},
-			ImagePullPolicy: corev1.PullAlways, //TODO
-			Resources: corev1.ResourceRequirements{
-				Limits: corev1.ResourceList{
-					corev1.ResourceCPU:    limCPU,
-					corev1.ResourceMemory: limMem,
-				},
-				Requests: corev1.ResourceList{
-					corev1.ResourceCPU:    reqCPU,
-					corev1.ResourceMemory: reqMem,
-				},
+	addInitContainer(pod, corev1.Container{
+		Name:            "appd-agent-attach-dotnetcore", //TODO
+		Image:           instrRules.InjectionRules.Image,
+		Command:         []string{"cp", "-r", "/opt/appdynamics/.", "/opt/appdynamics-dotnetcore"},
+		ImagePullPolicy: corev1.PullAlways, //TODO
+		Resources: corev1.ResourceRequirements{
+			Limits: corev1.ResourceList{
+				corev1.ResourceCPU:    limCPU,
+				corev1.ResourceMemory: limMem,
+			},
+			Requests: corev1.ResourceList{
+				corev1.ResourceCPU:    reqCPU,
+				corev1.ResourceMemory: reqMem,
 			},
-			VolumeMounts: []corev1.VolumeMount{{
-				MountPath: "/opt/appdynamics-dotnetcore", //TODO
-				Name:      "appd-agent-repo-dotnetcore",  //TODO
-			}},
 		},
+		VolumeMounts: []corev1.VolumeMount{{
+			MountPath: "/opt/appdynamics-dotnetcore", //TODO
+			Name:      "appd-agent-repo-dotnetcore",  //TODO
+		}},
 	})
-	return patchOps
 }
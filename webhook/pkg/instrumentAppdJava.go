@@ -25,26 +25,24 @@ import (
 	"k8s.io/apimachinery/pkg/api/resource"
 )
 
-func javaAppdInstrumentation(pod corev1.Pod, instrRule *v1alpha1.InstrumentationSpec) []patchOperation {
-	patchOps := []patchOperation{}
-
-	patchOps = append(patchOps, addControllerEnvVars(0)...)
-	patchOps = append(patchOps, addJavaEnvVar(pod, instrRule, 0)...)
-	patchOps = append(patchOps, addContainerEnvVar("APPDYNAMICS_AGENT_APPLICATION_NAME", getApplicationName(pod, instrRule), 0))
-	patchOps = append(patchOps, addContainerEnvVar("APPDYNAMICS_AGENT_TIER_NAME", getTierName(pod, instrRule), 0))
+func javaAppdInstrumentation(pod *corev1.Pod, instrRule *v1alpha1.InstrumentationSpec, containerIdx int) {
+	addControllerEnvVars(pod, containerIdx)
+	addJavaEnvVar(pod, instrRule, containerIdx)
+	addContainerEnvVar(pod, "APPDYNAMICS_AGENT_APPLICATION_NAME", getApplicationName(pod, instrRule), containerIdx)
+	addContainerEnvVar(pod, "APPDYNAMICS_AGENT_TIER_NAME", getTierName(pod, instrRule), containerIdx)
 	if reuseNodeNames(instrRule) {
-		patchOps = append(patchOps, addContainerEnvVar("APPDYNAMICS_AGENT_REUSE_NODE_NAME_PREFIX", getTierName(pod, instrRule), 0))
+		addContainerEnvVar(pod, "APPDYNAMICS_AGENT_REUSE_NODE_NAME_PREFIX", getTierName(pod, instrRule), containerIdx)
 	}
 
-	patchOps = append(patchOps, addSpecifiedContainerEnvVars(instrRule.InjectionRules.EnvVars, 0)...)
+	addSpecifiedContainerEnvVars(pod, instrRule.InjectionRules.EnvVars, containerIdx)
 
-	patchOps = append(patchOps, addNetvizEnvVars(pod, instrRule, 0)...)
+	addNetvizEnvVars(pod, instrRule, containerIdx)
 
-	patchOps = append(patchOps, addJavaAgentVolumeMount(pod, instrRule, 0)...)
+	addJavaAgentVolumeMount(pod, instrRule, containerIdx)
 
-	patchOps = append(patchOps, addJavaAgentInitContainer(pod, instrRule)...)
+	addJavaAgentInitContainer(pod, instrRule)
 
-	patchOps = append(patchOps, addJavaAgentVolume(pod, instrRule)...)
+	addJavaAgentVolume(pod, instrRule)
 
 	if instrRule.InjectionRules.OpenTelemetryCollector != "" {
 		otelCollConfig, _, err := getCollectorConfigsByName(pod.GetNamespace(), instrRule.InjectionRules.OpenTelemetryCollector)
@@ -53,51 +51,37 @@ func javaAppdInstrumentation(pod corev1.Pod, instrRule *v1alpha1.Instrumentation
 			log.Printf("Cannot find OTel collector definition %s\n", instrRule.InjectionRules.OpenTelemetryCollector)
 		} else {
 			if otelCollConfig.Mode == "sidecar" {
-				patchOps = append(patchOps, addOtelCollSidecar(pod, instrRule, 0)...)
+				addOtelCollSidecar(pod, instrRule, containerIdx)
 			}
 		}
 	}
-
-	return patchOps
 }
 
-func addJavaEnvVar(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerIdx int) []patchOperation {
-	patchOps := []patchOperation{}
-
+func addJavaEnvVar(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerIdx int) {
 	// fmt.Println(asJson(instrRules, "INSTRUMENTATION RULES"))
 	// time.Sleep(1 * time.Second)
 
-	patchOps = append(patchOps, addK8SOtelResourceAttrs(pod, instrRules, containerIdx, "OTEL_RESOURCE_ATTRIBUTES")...)
+	addK8SOtelResourceAttrs(pod, instrRules, containerIdx, "OTEL_RESOURCE_ATTRIBUTES")
 
-	patchOps = append(patchOps, patchOperation{
-		Op:   "add",
-		Path: fmt.Sprintf("/spec/containers/%d/env/-", containerIdx),
-		Value: corev1.EnvVar{
-			Name:  instrRules.InjectionRules.JavaEnvVar,
-			Value: getJavaOptions(pod, instrRules),
-		},
+	addContainerEnv(pod, containerIdx, corev1.EnvVar{
+		Name:  instrRules.InjectionRules.JavaEnvVar,
+		Value: getJavaOptions(pod, instrRules),
 	})
 
 	if !reuseNodeNames(instrRules) {
-		patchOps = append(patchOps, patchOperation{
-			Op:   "add",
-			Path: fmt.Sprintf("/spec/containers/%d/env/-", containerIdx),
-			Value: corev1.EnvVar{
-				Name: "APPDYNAMICS_AGENT_NODE_NAME",
-				ValueFrom: &corev1.EnvVarSource{
-					FieldRef: &corev1.ObjectFieldSelector{
-						APIVersion: "v1",
-						FieldPath:  "metadata.name",
-					},
+		addContainerEnv(pod, containerIdx, corev1.EnvVar{
+			Name: "APPDYNAMICS_AGENT_NODE_NAME",
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{
+					APIVersion: "v1",
+					FieldPath:  "metadata.name",
 				},
 			},
 		})
 	}
-
-	return patchOps
 }
 
-func getJavaOptions(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) string {
+func getJavaOptions(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) string {
 	javaOpts := " "
 
 	if config.ControllerConfig.UseProxy {
@@ -138,36 +122,23 @@ func getJavaOptions(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) st
 	return javaOpts
 }
 
-func addJavaAgentVolumeMount(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerIdx int) []patchOperation {
-	patchOps := []patchOperation{}
-	patchOps = append(patchOps, patchOperation{
-		Op:   "add",
-		Path: fmt.Sprintf("/spec/containers/%d/volumeMounts/-", containerIdx),
-		Value: corev1.VolumeMount{
-			MountPath: "/opt/appdynamics-java", //TODO
-			Name:      "appd-agent-repo-java",  //TODO
-		},
+func addJavaAgentVolumeMount(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerIdx int) {
+	addContainerVolumeMount(pod, containerIdx, corev1.VolumeMount{
+		MountPath: "/opt/appdynamics-java", //TODO
+		Name:      "appd-agent-repo-java",  //TODO
 	})
-	return patchOps
 }
 
-func addJavaAgentVolume(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) []patchOperation {
-	patchOps := []patchOperation{}
-	patchOps = append(patchOps, patchOperation{
-		Op:   "add",
-		Path: "/spec/volumes/-",
-		Value: corev1.Volume{
-			Name: "appd-agent-repo-java", //TODO
-			VolumeSource: corev1.VolumeSource{
-				EmptyDir: &corev1.EmptyDirVolumeSource{},
-			},
+func addJavaAgentVolume(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) {
+	addVolume(pod, corev1.Volume{
+		Name: "appd-agent-repo-java", //TODO
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{},
 		},
 	})
-	return patchOps
 }
 
-func addJavaAgentInitContainer(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) []patchOperation {
-	patchOps := []patchOperation{}
+func addJavaAgentInitContainer(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) {
 	limCPU, _ := resource.ParseQuantity("200m")
 	limMem, _ := resource.ParseQuantity("75M")
 	reqCPU, _ := resource.ParseQuantity(instrRules.InjectionRules.ResourceReservation.CPU)
@@ -179,31 +150,26 @@ func addJavaAgentInitContainer(pod corev1.Pod, instrRules *v1alpha1.Instrumentat
 		argsStr += "for i in /opt/appdynamics-java/ver*/conf/logging/log4j2.xml; do sed -i 's/level=\"info\"/level=\"" + instrRules.InjectionRules.LogLevel + "\"/g' $i ; done"
 	}
 
-	patchOps = append(patchOps, patchOperation{
-		Op:   "add",
-		Path: "/spec/initContainers/-",
-		Value: corev1.Container{
-			Name:  "appd-agent-attach-java", //TODO
-			Image: instrRules.InjectionRules.Image,
-			// Command:         []string{"cp", "-r", "/opt/appdynamics/.", "/opt/appdynamics-java"},
-			Command:         []string{"/bin/sh", "-c"},
-			Args:            []string{argsStr},
-			ImagePullPolicy: corev1.PullAlways, //TODO
-			Resources: corev1.ResourceRequirements{
-				Limits: corev1.ResourceList{
-					corev1.ResourceCPU:    limCPU,
-					corev1.ResourceMemory: limMem,
-				},
-				Requests: corev1.ResourceList{
-					corev1.ResourceCPU:    reqCPU,
-					corev1.ResourceMemory: reqMem,
-				},
+	addInitContainer(pod, corev1.Container{
+		Name:  "appd-agent-attach-java", //TODO
+		Image: instrRules.InjectionRules.Image,
+		// Command:         []string{"cp", "-r", "/opt/appdynamics/.", "/opt/appdynamics-java"},
+		Command:         []string{"/bin/sh", "-c"},
+		Args:            []string{argsStr},
+		ImagePullPolicy: corev1.PullAlways, //TODO
+		Resources: corev1.ResourceRequirements{
+			Limits: corev1.ResourceList{
+				corev1.ResourceCPU:    limCPU,
+				corev1.ResourceMemory: limMem,
+			},
+			Requests: corev1.ResourceList{
+				corev1.ResourceCPU:    reqCPU,
+				corev1.ResourceMemory: reqMem,
 			},
-			VolumeMounts: []corev1.VolumeMount{{
-				MountPath: "/opt/appdynamics-java", //TODO
-				Name:      "appd-agent-repo-java",  //TODO
-			}},
 		},
+		VolumeMounts: []corev1.VolumeMount{{
+			MountPath: "/opt/appdynamics-java", //TODO
+			Name:      "appd-agent-repo-java",  //TODO
+		}},
 	})
-	return patchOps
 }
@@ -17,57 +17,46 @@ limitations under the License.
 package main
 
 import (
-	"fmt"
 	"v1alpha1"
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 )
 
-func nodejsAppdInstrumentation(pod corev1.Pod, instrRule *v1alpha1.InstrumentationSpec) []patchOperation {
-	patchOps := []patchOperation{}
-
-	patchOps = append(patchOps, addControllerEnvVars(0)...)
-	patchOps = append(patchOps, addNodejsEnvVar(pod, instrRule, 0)...)
-	patchOps = append(patchOps, addContainerEnvVar("APPDYNAMICS_AGENT_APPLICATION_NAME", getApplicationName(pod, instrRule), 0))
-	patchOps = append(patchOps, addContainerEnvVar("APPDYNAMICS_AGENT_TIER_NAME", getTierName(pod, instrRule), 0))
+func nodejsAppdInstrumentation(pod *corev1.Pod, instrRule *v1alpha1.InstrumentationSpec, containerIdx int) {
+	addControllerEnvVars(pod, containerIdx)
+	addNodejsEnvVar(pod, instrRule, containerIdx)
+	addContainerEnvVar(pod, "APPDYNAMICS_AGENT_APPLICATION_NAME", getApplicationName(pod, instrRule), containerIdx)
+	addContainerEnvVar(pod, "APPDYNAMICS_AGENT_TIER_NAME", getTierName(pod, instrRule), containerIdx)
 	if reuseNodeNames(instrRule) {
-		patchOps = append(patchOps, addContainerEnvVar("APPDYNAMICS_AGENT_REUSE_NODE_NAME_PREFIX", getTierName(pod, instrRule), 0))
+		addContainerEnvVar(pod, "APPDYNAMICS_AGENT_REUSE_NODE_NAME_PREFIX", getTierName(pod, instrRule), containerIdx)
 	}
 
 	// not sure it has to be there, but ClusterAgent does the following, too
-	// patchOps = append(patchOps, addContainerEnvVar("APPDYNAMICS_AGENT_NODE_NAME", getTierName(pod, instrRule), 0))
-
-	patchOps = append(patchOps, addSpecifiedContainerEnvVars(instrRule.InjectionRules.EnvVars, 0)...)
+	// addContainerEnvVar(pod, "APPDYNAMICS_AGENT_NODE_NAME", getTierName(pod, instrRule), containerIdx)
 
-	patchOps = append(patchOps, addNetvizEnvVars(pod, instrRule, 0)...)
+	addSpecifiedContainerEnvVars(pod, instrRule.InjectionRules.EnvVars, containerIdx)
 
-	patchOps = append(patchOps, addNodejsAgentVolumeMount(pod, instrRule, 0)...)
+	addNetvizEnvVars(pod, instrRule, containerIdx)
 
-	patchOps = append(patchOps, addNodejsAgentInitContainer(pod, instrRule)...)
+	addNodejsAgentVolumeMount(pod, instrRule, containerIdx)
 
-	patchOps = append(patchOps, addNodejsAgentVolume(pod, instrRule)...)
+	addNodejsAgentInitContainer(pod, instrRule)
 
-	return patchOps
+	addNodejsAgentVolume(pod, instrRule)
 }
 
-func addNodejsEnvVar(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerIdx int) []patchOperation {
-	patchOps := []patchOperation{}
-
-	patchOps = append(patchOps, addContainerEnvVar("NODE_OPTIONS", "--require /opt/appdynamics-nodejs/shim.js", 0))
+func addNodejsEnvVar(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerIdx int) {
+	addContainerEnvVar(pod, "NODE_OPTIONS", "--require /opt/appdynamics-nodejs/shim.js", containerIdx)
 	if reuseNodeNames(instrRules) {
-		patchOps = append(patchOps, addContainerEnvVar("APPDYNAMICS_AGENT_REUSE_NODE_NAME", "true", 0))
+		addContainerEnvVar(pod, "APPDYNAMICS_AGENT_REUSE_NODE_NAME", "true", containerIdx)
 	} else {
-		patchOps = append(patchOps, patchOperation{
-			Op:   "add",
-			Path: fmt.Sprintf("/spec/containers/%d/env/-", containerIdx),
-			Value: corev1.EnvVar{
-				Name: "APPDYNAMICS_AGENT_NODE_NAME",
-				ValueFrom: &corev1.EnvVarSource{
-					FieldRef: &corev1.ObjectFieldSelector{
-						APIVersion: "v1",
-						FieldPath:  "metadata.name",
-					},
+		addContainerEnv(pod, containerIdx, corev1.EnvVar{
+			Name: "APPDYNAMICS_AGENT_NODE_NAME",
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{
+					APIVersion: "v1",
+					FieldPath:  "metadata.name",
 				},
 			},
 		})
@@ -75,78 +64,58 @@ func addNodejsEnvVar(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, c
 
 	// Check for proxy settings, doc does not say anything
 	if config.ControllerConfig.UseProxy {
-		patchOps = append(patchOps, addContainerEnvVar("APPDYNAMICS_PROXY_HOST_NAME", config.ControllerConfig.ProxyHost, 0))
-		patchOps = append(patchOps, addContainerEnvVar("APPDYNAMICS_PROXY_PORT", config.ControllerConfig.ProxyPort, 0))
+		addContainerEnvVar(pod, "APPDYNAMICS_PROXY_HOST_NAME", config.ControllerConfig.ProxyHost, containerIdx)
+		addContainerEnvVar(pod, "APPDYNAMICS_PROXY_PORT", config.ControllerConfig.ProxyPort, containerIdx)
 		if config.ControllerConfig.ProxyUser != "" {
-			patchOps = append(patchOps, addContainerEnvVar("APPDYNAMICS_PROXY_AUTH_NAME", config.ControllerConfig.ProxyUser, 0))
-			patchOps = append(patchOps, addContainerEnvVar("APPDYNAMICS_PROXY_AUTH_PASSWORD", config.ControllerConfig.ProxyPassword, 0))
+			addContainerEnvVar(pod, "APPDYNAMICS_PROXY_AUTH_NAME", config.ControllerConfig.ProxyUser, containerIdx)
+			addContainerEnvVar(pod, "APPDYNAMICS_PROXY_AUTH_PASSWORD", config.ControllerConfig.ProxyPassword, containerIdx)
 		}
 		if config.ControllerConfig.ProxyDomain != "" {
-			patchOps = append(patchOps, addContainerEnvVar("APPDYNAMICS_PROXY_AUTH_DOMAIN", config.ControllerConfig.ProxyDomain, 0))
+			addContainerEnvVar(pod, "APPDYNAMICS_PROXY_AUTH_DOMAIN", config.ControllerConfig.ProxyDomain, containerIdx)
 		}
 	}
-
-	return patchOps
 }
 
-func addNodejsAgentVolumeMount(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerIdx int) []patchOperation {
-	patchOps := []patchOperation{}
-	patchOps = append(patchOps, patchOperation{
-		Op:   "add",
-		Path: fmt.Sprintf("/spec/containers/%d/volumeMounts/-", containerIdx),
-		Value: corev1.VolumeMount{
-			MountPath: "/opt/appdynamics-nodejs", //TODO
-			Name:      "appd-agent-repo-nodejs",  //TODO
-		},
+func addNodejsAgentVolumeMount(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerIdx int) {
+	addContainerVolumeMount(pod, containerIdx, corev1.VolumeMount{
+		MountPath: "/opt/appdynamics-nodejs", //TODO
+		Name:      "appd-agent-repo-nodejs",  //TODO
 	})
-	return patchOps
 }
 
-func addNodejsAgentVolume(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) []patchOperation {
-	patchOps := []patchOperation{}
-	patchOps = append(patchOps, patchOperation{
-		Op:   "add",
-		Path: "/spec/volumes/-",
-		Value: corev1.Volume{
-			Name: "appd-agent-repo-nodejs", //TODO
-			VolumeSource: corev1.VolumeSource{
-				EmptyDir: &corev1.EmptyDirVolumeSource{},
-			},
+func addNodejsAgentVolume(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) {
+	addVolume(pod, corev1.Volume{
+		Name: "appd-agent-repo-nodejs", //TODO
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{},
 		},
 	})
-	return patchOps
 }
 
-func addNodejsAgentInitContainer(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) []patchOperation {
-	patchOps := []patchOperation{}
+func addNodejsAgentInitContainer(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) {
 	limCPU, _ := resource.ParseQuantity("200m")
 	limMem, _ := resource.ParseQuantity("75M")
 	reqCPU, _ := resource.ParseQuantity(instrRules.InjectionRules.ResourceReservation.CPU)
 	reqMem, _ := resource.ParseQuantity(instrRules.InjectionRules.ResourceReservation.Memory)
 
-	patchOps = append(patchOps, patchOperation{
-		Op:   "add",
-		Path: "/spec/initContainers/-",
-		Value: corev1.Container{
-			Name:            "appd-agent-attach-nodejs", //TODO
-			Image:           instrRules.InjectionRules.Image,
-			Command:         []string{"cp", "-r", "/opt/appdynamics/.", "/opt/appdynamics-nodejs"},
-			ImagePullPolicy: corev1.PullAlways, //TODO
-			Resources: corev1.ResourceRequirements{
-				Limits: corev1.ResourceList{
-					corev1.ResourceCPU:    limCPU,
-					corev1.ResourceMemory: limMem,
-				},
-				Requests: corev1.ResourceList{
-					corev1.ResourceCPU:    reqCPU,
-					corev1.ResourceMemory: reqMem,
-				},
+	addInitContainer(pod, corev1.Container{
+		Name:            "appd-agent-attach-nodejs", //TODO
+		Image:           instrRules.InjectionRules.Image,
+		Command:         []string{"cp", "-r", "/opt/appdynamics/.", "/opt/appdynamics-nodejs"},
+		ImagePullPolicy: corev1.PullAlways, //TODO
+		Resources: corev1.ResourceRequirements{
+			Limits: corev1.ResourceList{
+				corev1.ResourceCPU:    limCPU,
+				corev1.ResourceMemory: limMem,
+			},
+			Requests: corev1.ResourceList{
+				corev1.ResourceCPU:    reqCPU,
+				corev1.ResourceMemory: reqMem,
 			},
-			VolumeMounts: []corev1.VolumeMount{{
-				MountPath: "/opt/appdynamics-nodejs", //TODO
-				Name:      "appd-agent-repo-nodejs",  //TODO
-			}},
 		},
+		VolumeMounts: []corev1.VolumeMount{{
+			MountPath: "/opt/appdynamics-nodejs", //TODO
+			Name:      "appd-agent-repo-nodejs",  //TODO
+		}},
 	})
-	return patchOps
 }
@@ -30,21 +30,19 @@ const OTEL_WEBSERVER_DIR = "/opt/opentelemetry-webserver"
 const OTEL_WEBSERVER_AGENT_DIR = OTEL_WEBSERVER_DIR + "/agent"
 const OTEL_WEBSERVER_CONFIG_DIR = OTEL_WEBSERVER_DIR + "/source-conf"
 
-func apacheOtelInstrumentation(pod corev1.Pod, instrRule *v1alpha1.InstrumentationSpec) []patchOperation {
-	patchOps := []patchOperation{}
+func apacheOtelInstrumentation(pod *corev1.Pod, instrRule *v1alpha1.InstrumentationSpec, containerId int) {
+	// clone the application container as it was passed, before it gets modified
+	addApacheApplicationContainerCloneAsInit(pod, instrRule, containerId)
+	dropApachePassedConfig(pod, instrRule, containerId)
 
-	containerId := 0
+	addOtelApacheEnvVar(pod, instrRule, containerId)
+	addSpecifiedContainerEnvVars(pod, instrRule.InjectionRules.EnvVars, containerId)
 
-	patchOps = append(patchOps, addOtelApacheEnvVar(pod, instrRule, containerId)...)
-	patchOps = append(patchOps, addSpecifiedContainerEnvVars(instrRule.InjectionRules.EnvVars, containerId)...)
+	addOtelApacheAgentVolumeMount(pod, instrRule, containerId)
+	addOtelApacheAgentInitContainer(pod, instrRule)
 
-	patchOps = append(patchOps, addOtelApacheAgentVolumeMount(pod, instrRule, containerId)...)
-	patchOps = append(patchOps, addApacheApplicationContainerCloneAsInit(pod, instrRule, containerId)...)
-	patchOps = append(patchOps, dropApachePassedConfig(pod, instrRule, containerId)...)
-	patchOps = append(patchOps, addOtelApacheAgentInitContainer(pod, instrRule)...)
-
-	patchOps = append(patchOps, addOtelApacheAgentVolume(pod, instrRule)...)
-	patchOps = append(patchOps, addOtelApacheSourceConfVolume(pod, instrRule)...)
+	addOtelApacheAgentVolume(pod, instrRule)
+	addOtelApacheSourceConfVolume(pod, instrRule)
 
 	if instrRule.InjectionRules.OpenTelemetryCollector != "" {
 		otelCollConfig, _, err := getCollectorConfigsByName(pod.GetNamespace(), instrRule.InjectionRules.OpenTelemetryCollector)
@@ -53,132 +51,98 @@ func apacheOtelInstrumentation(pod corev1.Pod, instrRule *v1alpha1.Instrumentati
 			log.Printf("Cannot find OTel collector definition %s\n", instrRule.InjectionRules.OpenTelemetryCollector)
 		} else {
 			if otelCollConfig.Mode == "sidecar" {
-				patchOps = append(patchOps, addOtelCollSidecar(pod, instrRule, 0)...)
+				addOtelCollSidecar(pod, instrRule, containerId)
 			}
 		}
 	} else {
 		log.Printf("Cannot find OTel collector definition %v\n", instrRule.InjectionRules)
 	}
-
-	return patchOps
 }
 
-func addOtelApacheEnvVar(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerIdx int) []patchOperation {
-	patchOps := []patchOperation{}
-
-	patchOps = append(patchOps, addK8SOtelResourceAttrs(pod, instrRules, containerIdx, "OTEL_RESOURCE_ATTRIBUTES")...)
-
-	return patchOps
+func addOtelApacheEnvVar(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerIdx int) {
+	addK8SOtelResourceAttrs(pod, instrRules, containerIdx, "OTEL_RESOURCE_ATTRIBUTES")
 }
 
-func addOtelApacheAgentVolumeMount(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerIdx int) []patchOperation {
-	patchOps := []patchOperation{}
+func addOtelApacheAgentVolumeMount(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerIdx int) {
 	// directory with modified Apache conf directory
-	patchOps = append(patchOps, patchOperation{
-		Op:   "add",
-		Path: fmt.Sprintf("/spec/containers/%d/volumeMounts/-", containerIdx),
-		Value: corev1.VolumeMount{
-			MountPath: "/usr/local/apache2/conf",
-			Name:      "apache-conf-dir",
-		},
+	addContainerVolumeMount(pod, containerIdx, corev1.VolumeMount{
+		MountPath: "/usr/local/apache2/conf",
+		Name:      "apache-conf-dir",
 	})
 	// directory with webserver agent
-	patchOps = append(patchOps, patchOperation{
-		Op:   "add",
-		Path: fmt.Sprintf("/spec/containers/%d/volumeMounts/-", containerIdx),
-		Value: corev1.VolumeMount{
-			MountPath: OTEL_WEBSERVER_AGENT_DIR, //TODO
-			Name:      "otel-agent-repo-apache", //TODO
-		},
+	addContainerVolumeMount(pod, containerIdx, corev1.VolumeMount{
+		MountPath: OTEL_WEBSERVER_AGENT_DIR, //TODO
+		Name:      "otel-agent-repo-apache", //TODO
 	})
-	return patchOps
 }
 
-func addOtelApacheAgentVolume(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) []patchOperation {
-	patchOps := []patchOperation{}
-	patchOps = append(patchOps, patchOperation{
-		Op:   "add",
-		Path: "/spec/volumes/-",
-		Value: corev1.Volume{
-			Name: "otel-agent-repo-apache", //TODO
-			VolumeSource: corev1.VolumeSource{
-				EmptyDir: &corev1.EmptyDirVolumeSource{},
-			},
+func addOtelApacheAgentVolume(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) {
+	addVolume(pod, corev1.Volume{
+		Name: "otel-agent-repo-apache", //TODO
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{},
 		},
 	})
-	return patchOps
 }
 
-func addOtelApacheSourceConfVolume(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) []patchOperation {
-	patchOps := []patchOperation{}
-	patchOps = append(patchOps, patchOperation{
-		Op:   "add",
-		Path: "/spec/volumes/-",
-		Value: corev1.Volume{
-			Name: "apache-conf-dir", //TODO
-			VolumeSource: corev1.VolumeSource{
-				EmptyDir: &corev1.EmptyDirVolumeSource{},
-			},
+func addOtelApacheSourceConfVolume(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) {
+	addVolume(pod, corev1.Volume{
+		Name: "apache-conf-dir", //TODO
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{},
 		},
 	})
-	return patchOps
 }
 
-func addOtelApacheAgentInitContainer(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) []patchOperation {
-	patchOps := []patchOperation{}
+func addOtelApacheAgentInitContainer(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) {
 	limCPU, _ := resource.ParseQuantity("200m")
 	limMem, _ := resource.ParseQuantity("75M")
 	reqCPU, _ := resource.ParseQuantity(instrRules.InjectionRules.ResourceReservation.CPU)
 	reqMem, _ := resource.ParseQuantity(instrRules.InjectionRules.ResourceReservation.Memory)
 
-	patchOps = append(patchOps, patchOperation{
-		Op:   "add",
-		Path: "/spec/initContainers/-",
-		Value: corev1.Container{
-			Name:    "otel-agent-attach-apache", //TODO
-			Image:   instrRules.InjectionRules.Image,
-			Command: []string{"/bin/sh", "-c"},
-			Args: []string{
-				"cp -ar /opt/opentelemetry/* " + OTEL_WEBSERVER_AGENT_DIR + " && " +
-					"export agentLogDir=$(echo \"" + OTEL_WEBSERVER_AGENT_DIR + "/logs\" | sed 's,/,\\\\/,g') && " +
-					"cat " + OTEL_WEBSERVER_AGENT_DIR + "/conf/appdynamics_sdk_log4cxx.xml.template | sed 's/__agent_log_dir__/'${agentLogDir}'/g'  > " + OTEL_WEBSERVER_AGENT_DIR + "/conf/appdynamics_sdk_log4cxx.xml &&" +
-					"echo \"$OPENTELEMETRY_MODULE_CONF\" > " + OTEL_WEBSERVER_CONFIG_DIR + "/opentelemetry_module.conf && " +
-					"cat " + OTEL_WEBSERVER_CONFIG_DIR + "/opentelemetry_module.conf && " +
-					"echo 'Include /usr/local/apache2/conf/opentelemetry_module.conf' >> " + OTEL_WEBSERVER_CONFIG_DIR + "/httpd.conf",
+	addInitContainer(pod, corev1.Container{
+		Name:    "otel-agent-attach-apache", //TODO
+		Image:   instrRules.InjectionRules.Image,
+		Command: []string{"/bin/sh", "-c"},
+		Args: []string{
+			"cp -ar /opt/opentelemetry/* " + OTEL_WEBSERVER_AGENT_DIR + " && " +
+				"export agentLogDir=$(echo \"" + OTEL_WEBSERVER_AGENT_DIR + "/logs\" | sed 's,/,\\\\/,g') && " +
+				"cat " + OTEL_WEBSERVER_AGENT_DIR + "/conf/appdynamics_sdk_log4cxx.xml.template | sed 's/__agent_log_dir__/'${agentLogDir}'/g'  > " + OTEL_WEBSERVER_AGENT_DIR + "/conf/appdynamics_sdk_log4cxx.xml &&" +
+				"echo \"$OPENTELEMETRY_MODULE_CONF\" > " + OTEL_WEBSERVER_CONFIG_DIR + "/opentelemetry_module.conf && " +
+				"cat " + OTEL_WEBSERVER_CONFIG_DIR + "/opentelemetry_module.conf && " +
+				"echo 'Include /usr/local/apache2/conf/opentelemetry_module.conf' >> " + OTEL_WEBSERVER_CONFIG_DIR + "/httpd.conf",
+		},
+		ImagePullPolicy: corev1.PullAlways,
+		Env: []corev1.EnvVar{
+			{
+				Name:  "OPENTELEMETRY_MODULE_CONF",
+				Value: getApacheOtelConfig(pod, instrRules),
+			},
+		},
+		Resources: corev1.ResourceRequirements{
+			Limits: corev1.ResourceList{
+				corev1.ResourceCPU:    limCPU,
+				corev1.ResourceMemory: limMem,
 			},
-			ImagePullPolicy: corev1.PullAlways,
-			Env: []corev1.EnvVar{
-				{
-					Name:  "OPENTELEMETRY_MODULE_CONF",
-					Value: getApacheOtelConfig(pod, instrRules),
-				},
+			Requests: corev1.ResourceList{
+				corev1.ResourceCPU:    reqCPU,
+				corev1.ResourceMemory: reqMem,
 			},
-			Resources: corev1.ResourceRequirements{
-				Limits: corev1.ResourceList{
-					corev1.ResourceCPU:    limCPU,
-					corev1.ResourceMemory: limMem,
-				},
-				Requests: corev1.ResourceList{
-					corev1.ResourceCPU:    reqCPU,
-					corev1.ResourceMemory: reqMem,
-				},
+		},
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				MountPath: OTEL_WEBSERVER_CONFIG_DIR,
+				Name:      "apache-conf-dir",
 			},
-			VolumeMounts: []corev1.VolumeMount{
-				{
-					MountPath: OTEL_WEBSERVER_CONFIG_DIR,
-					Name:      "apache-conf-dir",
-				},
-				{
-					MountPath: OTEL_WEBSERVER_AGENT_DIR,
-					Name:      "otel-agent-repo-apache",
-				},
+			{
+				MountPath: OTEL_WEBSERVER_AGENT_DIR,
+				Name:      "otel-agent-repo-apache",
 			},
 		},
 	})
-	return patchOps
 }
 
-func getApacheOtelConfig(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) string {
+func getApacheOtelConfig(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) string {
 	template := `
 LoadFile %[1]s/sdk_lib/lib/libopentelemetry_common.so
 LoadFile %[1]s/sdk_lib/lib/libopentelemetry_resources.so
@@ -250,8 +214,7 @@ ApacheModuleTraceAsError ON
 		pod.GetName()+pod.GetGenerateName()+"a")
 }
 
-func addApacheApplicationContainerCloneAsInit(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerId int) []patchOperation {
-	patchOps := []patchOperation{}
+func addApacheApplicationContainerCloneAsInit(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerId int) {
 	limCPU, _ := resource.ParseQuantity("200m")
 	limMem, _ := resource.ParseQuantity("75M")
 	reqCPU, _ := resource.ParseQuantity(instrRules.InjectionRules.ResourceReservation.CPU)
@@ -278,25 +241,16 @@ func addApacheApplicationContainerCloneAsInit(pod corev1.Pod, instrRules *v1alph
 	initContainerSpec.Command = []string{"/bin/sh", "-c"}
 	initContainerSpec.Args = []string{"cp -r /usr/local/apache2/conf/* " + OTEL_WEBSERVER_CONFIG_DIR}
 
-	patchOps = append(patchOps, patchOperation{
-		Op:    "add",
-		Path:  "/spec/initContainers/-",
-		Value: initContainerSpec,
-	})
-	return patchOps
+	addInitContainer(pod, *initContainerSpec)
 }
 
-func dropApachePassedConfig(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerId int) []patchOperation {
-	patchOps := []patchOperation{}
-
-	for idx, volume := range pod.Spec.Containers[containerId].VolumeMounts {
+func dropApachePassedConfig(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerId int) {
+	volumeMounts := []corev1.VolumeMount{}
+	for _, volume := range pod.Spec.Containers[containerId].VolumeMounts {
 		if strings.Contains(volume.MountPath, "/usr/local/apache2/conf") { // potentially passes config, which we want to pass to init copy only
-			patchOps = append(patchOps, patchOperation{
-				Op:   "remove",
-				Path: fmt.Sprintf("/spec/containers/%d/volumeMounts/%d", containerId, idx),
-			})
+			continue
 		}
+		volumeMounts = append(volumeMounts, volume)
 	}
-
-	return patchOps
+	pod.Spec.Containers[containerId].VolumeMounts = volumeMounts
 }
@@ -25,18 +25,16 @@ import (
 	"k8s.io/apimachinery/pkg/api/resource"
 )
 
-func dotnetOtelInstrumentation(pod corev1.Pod, instrRule *v1alpha1.InstrumentationSpec) []patchOperation {
-	patchOps := []patchOperation{}
+func dotnetOtelInstrumentation(pod *corev1.Pod, instrRule *v1alpha1.InstrumentationSpec, containerIdx int) {
+	//	addControllerEnvVars(pod, containerIdx)
+	addOtelDotnetEnvVar(pod, instrRule, containerIdx)
 
-	//	patchOps = append(patchOps, addControllerEnvVars(0)...)
-	patchOps = append(patchOps, addOtelDotnetEnvVar(pod, instrRule, 0)...)
+	addContainerEnvVar(pod, "OTEL_SERVICE_NAMESPACE", getApplicationName(pod, instrRule), containerIdx)
+	addContainerEnvVar(pod, "OTEL_SERVICE_NAME", getTierName(pod, instrRule), containerIdx)
+	addContainerEnvVar(pod, "OTEL_RESOURCE_ATTRIBUTES",
+		fmt.Sprintf("service.name=%s,service.namespace=%s", getTierName(pod, instrRule), getApplicationName(pod, instrRule)), containerIdx)
 
-	patchOps = append(patchOps, addContainerEnvVar("OTEL_SERVICE_NAMESPACE", getApplicationName(pod, instrRule), 0))
-	patchOps = append(patchOps, addContainerEnvVar("OTEL_SERVICE_NAME", getTierName(pod, instrRule), 0))
-	patchOps = append(patchOps, addContainerEnvVar("OTEL_RESOURCE_ATTRIBUTES",
-		fmt.Sprintf("service.name=%s,service.namespace=%s", getTierName(pod, instrRule), getApplicationName(pod, instrRule)), 0))
-
-	patchOps = append(patchOps, addContainerEnvVar("OTEL_TRACES_EXPORTER", "otlp", 0))
+	addContainerEnvVar(pod, "OTEL_TRACES_EXPORTER", "otlp", containerIdx)
 
 	if instrRule.InjectionRules.OpenTelemetryCollector != "" {
 		otelCollConfig, _, err := getCollectorConfigsByName(pod.GetNamespace(), instrRule.InjectionRules.OpenTelemetryCollector)
@@ -45,27 +43,24 @@ func dotnetOtelInstrumentation(pod corev1.Pod, instrRule *v1alpha1.Instrumentati
 			log.Printf("Cannot find OTel collector definition %s\n", instrRule.InjectionRules.OpenTelemetryCollector)
 		} else {
 			if otelCollConfig.Mode == "sidecar" {
-				patchOps = append(patchOps, addContainerEnvVar("OTEL_EXPORTER_OTLP_ENDPOINT", "http://localhost:4318", 0))
-				patchOps = append(patchOps, addOtelCollSidecar(pod, instrRule, 0)...)
+				addContainerEnvVar(pod, "OTEL_EXPORTER_OTLP_ENDPOINT", "http://localhost:4318", containerIdx)
+				addOtelCollSidecar(pod, instrRule, containerIdx)
 			} else if (otelCollConfig.Mode == "deployment") || (otelCollConfig.Mode == "external") {
-				patchOps = append(patchOps, addContainerEnvVar("OTEL_EXPORTER_OTLP_ENDPOINT", fmt.Sprintf("http://%s:4318", otelCollConfig.ServiceName), 0))
+				addContainerEnvVar(pod, "OTEL_EXPORTER_OTLP_ENDPOINT", fmt.Sprintf("http://%s:4318", otelCollConfig.ServiceName), containerIdx)
 			}
 		}
 	}
 
-	patchOps = append(patchOps, addSpecifiedContainerEnvVars(instrRule.InjectionRules.EnvVars, 0)...)
-
-	patchOps = append(patchOps, addOtelDotnetAgentVolumeMount(pod, instrRule, 0)...)
+	addSpecifiedContainerEnvVars(pod, instrRule.InjectionRules.EnvVars, containerIdx)
 
-	patchOps = append(patchOps, addOtelDotnetAgentInitContainer(pod, instrRule)...)
+	addOtelDotnetAgentVolumeMount(pod, instrRule, containerIdx)
 
-	patchOps = append(patchOps, addOtelDotnetAgentVolume(pod, instrRule)...)
+	addOtelDotnetAgentInitContainer(pod, instrRule)
 
-	return patchOps
+	addOtelDotnetAgentVolume(pod, instrRule)
 }
 
-func addOtelDotnetEnvVar(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerIdx int) []patchOperation {
-	patchOps := []patchOperation{}
+func addOtelDotnetEnvVar(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerIdx int) {
 	/*
 	 * COR_ENABLE_PROFILING=1
 	 * COR_PROFILER={918728DD-259F-4A6A-AC2B-B85E1B658318}
@@ -84,81 +79,61 @@ func addOtelDotnetEnvVar(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpe
 	*/
 
 	AGENT_PATH := "/opt/opentelemetry-agent"
-	patchOps = append(patchOps, addContainerEnvVar("OTEL_DOTNET_AUTO_TRACES_ENABLED", "true", 0))
-	patchOps = append(patchOps, addContainerEnvVar("OTEL_DOTNET_AUTO_METRICS_ENABLED", "false", 0))
-
-	patchOps = append(patchOps, addContainerEnvVar("CORECLR_ENABLE_PROFILING", "1", 0))
-	patchOps = append(patchOps, addContainerEnvVar("CORECLR_PROFILER", "{918728DD-259F-4A6A-AC2B-B85E1B658318}", 0))
-	patchOps = append(patchOps, addContainerEnvVar("COR_ENABLE_PROFILING", "1", 0))
-	patchOps = append(patchOps, addContainerEnvVar("COR_PROFILER", "{918728DD-259F-4A6A-AC2B-B85E1B658318}", 0))
-	patchOps = append(patchOps, addContainerEnvVar("DOTNET_ADDITIONAL_DEPS", fmt.Sprintf("%s/AdditionalDeps", AGENT_PATH), 0))
-	patchOps = append(patchOps, addContainerEnvVar("DOTNET_SHARED_STORE", fmt.Sprintf("%s/store", AGENT_PATH), 0))
-	patchOps = append(patchOps, addContainerEnvVar("DOTNET_STARTUP_HOOKS", fmt.Sprintf("%s/netcoreapp3.1/OpenTelemetry.AutoInstrumentation.StartupHook.dll", AGENT_PATH), 0))
-	patchOps = append(patchOps, addContainerEnvVar("OTEL_DOTNET_AUTO_HOME", fmt.Sprintf("%s", AGENT_PATH), 0))
-	patchOps = append(patchOps, addContainerEnvVar("OTEL_DOTNET_AUTO_INTEGRATIONS_FILE", fmt.Sprintf("%s/integrations.json", AGENT_PATH), 0))
-	patchOps = append(patchOps, addContainerEnvVar("CORECLR_PROFILER_PATH", fmt.Sprintf("%s/OpenTelemetry.AutoInstrumentation.Native.so", AGENT_PATH), 0))
-
-	return patchOps
+	addContainerEnvVar(pod, "OTEL_DOTNET_AUTO_TRACES_ENABLED", "true", containerIdx)
+	addContainerEnvVar(pod, "OTEL_DOTNET_AUTO_METRICS_ENABLED", "false", containerIdx)
+
+	addContainerEnvVar(pod, "CORECLR_ENABLE_PROFILING", "1", containerIdx)
+	addContainerEnvVar(pod, "CORECLR_PROFILER", "{918728DD-259F-4A6A-AC2B-B85E1B658318}", containerIdx)
+	addContainerEnvVar(pod, "COR_ENABLE_PROFILING", "1", containerIdx)
+	addContainerEnvVar(pod, "COR_PROFILER", "{918728DD-259F-4A6A-AC2B-B85E1B658318}", containerIdx)
+	addContainerEnvVar(pod, "DOTNET_ADDITIONAL_DEPS", fmt.Sprintf("%s/AdditionalDeps", AGENT_PATH), containerIdx)
+	addContainerEnvVar(pod, "DOTNET_SHARED_STORE", fmt.Sprintf("%s/store", AGENT_PATH), containerIdx)
+	addContainerEnvVar(pod, "DOTNET_STARTUP_HOOKS", fmt.Sprintf("%s/netcoreapp3.1/OpenTelemetry.AutoInstrumentation.StartupHook.dll", AGENT_PATH), containerIdx)
+	addContainerEnvVar(pod, "OTEL_DOTNET_AUTO_HOME", fmt.Sprintf("%s", AGENT_PATH), containerIdx)
+	addContainerEnvVar(pod, "OTEL_DOTNET_AUTO_INTEGRATIONS_FILE", fmt.Sprintf("%s/integrations.json", AGENT_PATH), containerIdx)
+	addContainerEnvVar(pod, "CORECLR_PROFILER_PATH", fmt.Sprintf("%s/OpenTelemetry.AutoInstrumentation.Native.so", AGENT_PATH), containerIdx)
 }
 
-func addOtelDotnetAgentVolumeMount(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerIdx int) []patchOperation {
-	patchOps := []patchOperation{}
-	patchOps = append(patchOps, patchOperation{
-		Op:   "add",
-		Path: fmt.Sprintf("/spec/containers/%d/volumeMounts/-", containerIdx),
-		Value: corev1.VolumeMount{
-			MountPath: "/opt/opentelemetry-agent",   //TODO
-			Name:      "otel-agent-repo-dotnetcore", //TODO
-		},
+func addOtelDotnetAgentVolumeMount(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerIdx int) {
+	addContainerVolumeMount(pod, containerIdx, corev1.VolumeMount{
+		MountPath: "/opt/opentelemetry-agent",   //TODO
+		Name:      "otel-agent-repo-dotnetcore", //TODO
 	})
-	return patchOps
 }
 
-func addOtelDotnetAgentVolume(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) []patchOperation {
-	patchOps := []patchOperation{}
-	patchOps = append(patchOps, patchOperation{
-		Op:   "add",
-		Path: "/spec/volumes/-",
-		Value: corev1.Volume{
-			Name: "otel-agent-repo-dotnetcore", //TODO
-			VolumeSource: corev1.VolumeSource{
-				EmptyDir: &corev1.EmptyDirVolumeSource{},
-			},
+func addOtelDotnetAgentVolume(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) {
+	addVolume(pod, corev1.Volume{
+		Name: "otel-agent-repo-dotnetcore", //TODO
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{},
 		},
 	})
-	return patchOps
 }
 
-func addOtelDotnetAgentInitContainer(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) []patchOperation {
-	patchOps := []patchOperation{}
+func addOtelDotnetAgentInitContainer(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) {
 	limCPU, _ := resource.ParseQuantity("200m")
 	limMem, _ := resource.ParseQuantity("75M")
 	reqCPU, _ := resource.ParseQuantity(instrRules.InjectionRules.ResourceReservation.CPU)
 	reqMem, _ := resource.ParseQuantity(instrRules.InjectionRules.ResourceReservation.Memory)
 
-	patchOps = append(patchOps, patchOperation{
-		Op:   "add",
-		Path: "/spec/initContainers/-",
-		Value: corev1.Container{
-			Name:            "otel-agent-attach-dotnetcore", //TODO
-			Image:           instrRules.InjectionRules.Image,
-			Command:         []string{"cp", "-r", "/opt/opentelemetry/.", "/opt/opentelemetry-agent"},
-			ImagePullPolicy: corev1.PullAlways, //TODO
-			Resources: corev1.ResourceRequirements{
-				Limits: corev1.ResourceList{
-					corev1.ResourceCPU:    limCPU,
-					corev1.ResourceMemory: limMem,
-				},
-				Requests: corev1.ResourceList{
-					corev1.ResourceCPU:    reqCPU,
-					corev1.ResourceMemory: reqMem,
-				},
+	addInitContainer(pod, corev1.Container{
+		Name:            "otel-agent-attach-dotnetcore", //TODO
+		Image:           instrRules.InjectionRules.Image,
+		Command:         []string{"cp", "-r", "/opt/opentelemetry/.", "/opt/opentelemetry-agent"},
+		ImagePullPolicy: corev1.PullAlways, //TODO
+		Resources: corev1.ResourceRequirements{
+			Limits: corev1.ResourceList{
+				corev1.ResourceCPU:    limCPU,
+				corev1.ResourceMemory: limMem,
+			},
+			Requests: corev1.ResourceList{
+				corev1.ResourceCPU:    reqCPU,
+				corev1.ResourceMemory: reqMem,
 			},
-			VolumeMounts: []corev1.VolumeMount{{
-				MountPath: "/opt/opentelemetry-agent",   //TODO
-				Name:      "otel-agent-repo-dotnetcore", //TODO
-			}},
 		},
+		VolumeMounts: []corev1.VolumeMount{{
+			MountPath: "/opt/opentelemetry-agent",   //TODO
+			Name:      "otel-agent-repo-dotnetcore", //TODO
+		}},
 	})
-	return patchOps
 }
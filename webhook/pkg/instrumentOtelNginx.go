@@ -26,21 +26,19 @@ import (
 	"k8s.io/apimachinery/pkg/api/resource"
 )
 
-func nginxOtelInstrumentation(pod corev1.Pod, instrRule *v1alpha1.InstrumentationSpec) []patchOperation {
-	patchOps := []patchOperation{}
+func nginxOtelInstrumentation(pod *corev1.Pod, instrRule *v1alpha1.InstrumentationSpec, containerId int) {
+	// clone the application container as it was passed, before it gets modified
+	addNginxApplicationContainerCloneAsInit(pod, instrRule, containerId)
+	dropNginxPassedConfig(pod, instrRule, containerId)
 
-	containerId := 0
+	addOtelNginxEnvVar(pod, instrRule, containerId)
+	addSpecifiedContainerEnvVars(pod, instrRule.InjectionRules.EnvVars, containerId)
 
-	patchOps = append(patchOps, addOtelNginxEnvVar(pod, instrRule, containerId)...)
-	patchOps = append(patchOps, addSpecifiedContainerEnvVars(instrRule.InjectionRules.EnvVars, containerId)...)
+	addOtelNginxAgentVolumeMount(pod, instrRule, containerId)
+	addOtelNginxAgentInitContainer(pod, instrRule)
 
-	patchOps = append(patchOps, addOtelNginxAgentVolumeMount(pod, instrRule, containerId)...)
-	patchOps = append(patchOps, addNginxApplicationContainerCloneAsInit(pod, instrRule, containerId)...)
-	patchOps = append(patchOps, dropNginxPassedConfig(pod, instrRule, containerId)...)
-	patchOps = append(patchOps, addOtelNginxAgentInitContainer(pod, instrRule)...)
-
-	patchOps = append(patchOps, addOtelNginxAgentVolume(pod, instrRule)...)
-	patchOps = append(patchOps, addOtelNginxSourceConfVolume(pod, instrRule)...)
+	addOtelNginxAgentVolume(pod, instrRule)
+	addOtelNginxSourceConfVolume(pod, instrRule)
 
 	if instrRule.InjectionRules.OpenTelemetryCollector != "" {
 		otelCollConfig, _, err := getCollectorConfigsByName(pod.GetNamespace(), instrRule.InjectionRules.OpenTelemetryCollector)
@@ -49,144 +47,106 @@ func nginxOtelInstrumentation(pod corev1.Pod, instrRule *v1alpha1.Instrumentatio
 			log.Printf("Cannot find OTel collector definition %s\n", instrRule.InjectionRules.OpenTelemetryCollector)
 		} else {
 			if otelCollConfig.Mode == "sidecar" {
-				patchOps = append(patchOps, addOtelCollSidecar(pod, instrRule, 0)...)
+				addOtelCollSidecar(pod, instrRule, containerId)
 			}
 		}
 	} else {
 		log.Printf("Cannot find OTel collector definition %v\n", instrRule.InjectionRules)
 	}
-
-	return patchOps
 }
 
-func addOtelNginxEnvVar(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerIdx int) []patchOperation {
-	patchOps := []patchOperation{}
-
-	patchOps = append(patchOps, patchOperation{
-		Op:   "add",
-		Path: fmt.Sprintf("/spec/containers/%d/env/-", containerIdx),
-		Value: corev1.EnvVar{
-			Name:  "LD_LIBRARY_PATH",
-			Value: OTEL_WEBSERVER_AGENT_DIR + "/sdk_lib/lib",
-		},
+func addOtelNginxEnvVar(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerIdx int) {
+	addContainerEnv(pod, containerIdx, corev1.EnvVar{
+		Name:  "LD_LIBRARY_PATH",
+		Value: OTEL_WEBSERVER_AGENT_DIR + "/sdk_lib/lib",
 	})
 
-	patchOps = append(patchOps, addK8SOtelResourceAttrs(pod, instrRules, containerIdx, "OTEL_RESOURCE_ATTRIBUTES")...)
-
-	return patchOps
+	addK8SOtelResourceAttrs(pod, instrRules, containerIdx, "OTEL_RESOURCE_ATTRIBUTES")
 }
 
-func addOtelNginxAgentVolumeMount(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerIdx int) []patchOperation {
-	patchOps := []patchOperation{}
+func addOtelNginxAgentVolumeMount(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerIdx int) {
 	// directory with modified Apache conf directory
-	patchOps = append(patchOps, patchOperation{
-		Op:   "add",
-		Path: fmt.Sprintf("/spec/containers/%d/volumeMounts/-", containerIdx),
-		Value: corev1.VolumeMount{
-			MountPath: "/etc/nginx",
-			Name:      "nginx-conf-dir",
-		},
+	addContainerVolumeMount(pod, containerIdx, corev1.VolumeMount{
+		MountPath: "/etc/nginx",
+		Name:      "nginx-conf-dir",
 	})
 	// directory with webserver agent
-	patchOps = append(patchOps, patchOperation{
-		Op:   "add",
-		Path: fmt.Sprintf("/spec/containers/%d/volumeMounts/-", containerIdx),
-		Value: corev1.VolumeMount{
-			MountPath: OTEL_WEBSERVER_AGENT_DIR, //TODO
-			Name:      "otel-agent-repo-nginx",  //TODO
-		},
+	addContainerVolumeMount(pod, containerIdx, corev1.VolumeMount{
+		MountPath: OTEL_WEBSERVER_AGENT_DIR, //TODO
+		Name:      "otel-agent-repo-nginx",  //TODO
 	})
-	return patchOps
 }
 
-func addOtelNginxAgentVolume(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) []patchOperation {
-	patchOps := []patchOperation{}
-	patchOps = append(patchOps, patchOperation{
-		Op:   "add",
-		Path: "/spec/volumes/-",
-		Value: corev1.Volume{
-			Name: "otel-agent-repo-nginx", //TODO
-			VolumeSource: corev1.VolumeSource{
-				EmptyDir: &corev1.EmptyDirVolumeSource{},
-			},
+func addOtelNginxAgentVolume(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) {
+	addVolume(pod, corev1.Volume{
+		Name: "otel-agent-repo-nginx", //TODO
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{},
 		},
 	})
-	return patchOps
 }
 
-func addOtelNginxSourceConfVolume(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) []patchOperation {
-	patchOps := []patchOperation{}
-	patchOps = append(patchOps, patchOperation{
-		Op:   "add",
-		Path: "/spec/volumes/-",
-		Value: corev1.Volume{
-			Name: "nginx-conf-dir", //TODO
-			VolumeSource: corev1.VolumeSource{
-				EmptyDir: &corev1.EmptyDirVolumeSource{},
-			},
+func addOtelNginxSourceConfVolume(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) {
+	addVolume(pod, corev1.Volume{
+		Name: "nginx-conf-dir", //TODO
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{},
 		},
 	})
-	return patchOps
 }
 
-func addOtelNginxAgentInitContainer(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) []patchOperation {
-	patchOps := []patchOperation{}
+func addOtelNginxAgentInitContainer(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) {
 	limCPU, _ := resource.ParseQuantity("200m")
 	limMem, _ := resource.ParseQuantity("75M")
 	reqCPU, _ := resource.ParseQuantity(instrRules.InjectionRules.ResourceReservation.CPU)
 	reqMem, _ := resource.ParseQuantity(instrRules.InjectionRules.ResourceReservation.Memory)
 
 	////////////////////////////////////////////////////////
-	patchOps = append(patchOps, patchOperation{
-		Op:   "add",
-		Path: "/spec/initContainers/-",
-		Value: corev1.Container{
-			Name:    "otel-agent-attach-nginx", //TODO
-			Image:   instrRules.InjectionRules.Image,
-			Command: []string{"/bin/sh", "-c"},
-			Args: []string{
-				"cp -ar /opt/opentelemetry/* " + OTEL_WEBSERVER_AGENT_DIR + " && " +
-					"export NGINX_VERSION=`cat " + OTEL_WEBSERVER_CONFIG_DIR + "/version.txt` && " +
-					"export agentLogDir=$(echo \"" + OTEL_WEBSERVER_AGENT_DIR + "/logs\" | sed 's,/,\\\\/,g') && " +
-					"cat " + OTEL_WEBSERVER_AGENT_DIR + "/conf/appdynamics_sdk_log4cxx.xml.template | sed 's/__agent_log_dir__/'${agentLogDir}'/g'  > " + OTEL_WEBSERVER_AGENT_DIR + "/conf/appdynamics_sdk_log4cxx.xml &&" +
-					"echo \"$OPENTELEMETRY_MODULE_CONF\" > " + OTEL_WEBSERVER_CONFIG_DIR + "/opentelemetry_agent.conf && " +
-					"sed -i \"1s,^,load_module " + OTEL_WEBSERVER_AGENT_DIR + "/WebServerModule/Nginx/${NGINX_VERSION}/ngx_http_opentelemetry_module.so;\\n,g\" " + OTEL_WEBSERVER_CONFIG_DIR + "/nginx.conf && " +
-					"sed -i \"1s,^,env OTEL_RESOURCE_ATTRIBUTES;\\n,g\" " + OTEL_WEBSERVER_CONFIG_DIR + "/nginx.conf && " +
-					"mv " + OTEL_WEBSERVER_CONFIG_DIR + "/opentelemetry_agent.conf " + OTEL_WEBSERVER_CONFIG_DIR + "/conf.d",
+	addInitContainer(pod, corev1.Container{
+		Name:    "otel-agent-attach-nginx", //TODO
+		Image:   instrRules.InjectionRules.Image,
+		Command: []string{"/bin/sh", "-c"},
+		Args: []string{
+			"cp -ar /opt/opentelemetry/* " + OTEL_WEBSERVER_AGENT_DIR + " && " +
+				"export NGINX_VERSION=`cat " + OTEL_WEBSERVER_CONFIG_DIR + "/version.txt` && " +
+				"export agentLogDir=$(echo \"" + OTEL_WEBSERVER_AGENT_DIR + "/logs\" | sed 's,/,\\\\/,g') && " +
+				"cat " + OTEL_WEBSERVER_AGENT_DIR + "/conf/appdynamics_sdk_log4cxx.xml.template | sed 's/__agent_log_dir__/'${agentLogDir}'/g'  > " + OTEL_WEBSERVER_AGENT_DIR + "/conf/appdynamics_sdk_log4cxx.xml &&" +
+				"echo \"$OPENTELEMETRY_MODULE_CONF\" > " + OTEL_WEBSERVER_CONFIG_DIR + "/opentelemetry_agent.conf && " +
+				"sed -i \"1s,^,load_module " + OTEL_WEBSERVER_AGENT_DIR + "/WebServerModule/Nginx/${NGINX_VERSION}/ngx_http_opentelemetry_module.so;\\n,g\" " + OTEL_WEBSERVER_CONFIG_DIR + "/nginx.conf && " +
+				"sed -i \"1s,^,env OTEL_RESOURCE_ATTRIBUTES;\\n,g\" " + OTEL_WEBSERVER_CONFIG_DIR + "/nginx.conf && " +
+				"mv " + OTEL_WEBSERVER_CONFIG_DIR + "/opentelemetry_agent.conf " + OTEL_WEBSERVER_CONFIG_DIR + "/conf.d",
+		},
+		ImagePullPolicy: corev1.PullAlways,
+		Env: []corev1.EnvVar{
+			{
+				Name:  "OPENTELEMETRY_MODULE_CONF",
+				Value: getNginxOtelConfig(pod, instrRules),
+			},
+		},
+		Resources: corev1.ResourceRequirements{
+			Limits: corev1.ResourceList{
+				corev1.ResourceCPU:    limCPU,
+				corev1.ResourceMemory: limMem,
 			},
-			ImagePullPolicy: corev1.PullAlways,
-			Env: []corev1.EnvVar{
-				{
-					Name:  "OPENTELEMETRY_MODULE_CONF",
-					Value: getNginxOtelConfig(pod, instrRules),
-				},
+			Requests: corev1.ResourceList{
+				corev1.ResourceCPU:    reqCPU,
+				corev1.ResourceMemory: reqMem,
 			},
-			Resources: corev1.ResourceRequirements{
-				Limits: corev1.ResourceList{
-					corev1.ResourceCPU:    limCPU,
-					corev1.ResourceMemory: limMem,
-				},
-				Requests: corev1.ResourceList{
-					corev1.ResourceCPU:    reqCPU,
-					corev1.ResourceMemory: reqMem,
-				},
+		},
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				MountPath: OTEL_WEBSERVER_CONFIG_DIR,
+				Name:      "nginx-conf-dir",
 			},
-			VolumeMounts: []corev1.VolumeMount{
-				{
-					MountPath: OTEL_WEBSERVER_CONFIG_DIR,
-					Name:      "nginx-conf-dir",
-				},
-				{
-					MountPath: OTEL_WEBSERVER_AGENT_DIR,
-					Name:      "otel-agent-repo-nginx",
-				},
+			{
+				MountPath: OTEL_WEBSERVER_AGENT_DIR,
+				Name:      "otel-agent-repo-nginx",
 			},
 		},
 	})
-	return patchOps
 }
 
-func getNginxOtelConfig(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) string {
+func getNginxOtelConfig(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) string {
 	template := `
 NginxModuleEnabled ON;
 NginxModuleOtelSpanExporter otlp;
@@ -225,8 +185,7 @@ NginxModuleTraceAsError ON;
 		pod.GetName()+pod.GetGenerateName()+"a")
 }
 
-func addNginxApplicationContainerCloneAsInit(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerId int) []patchOperation {
-	patchOps := []patchOperation{}
+func addNginxApplicationContainerCloneAsInit(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerId int) {
 	limCPU, _ := resource.ParseQuantity("200m")
 	limMem, _ := resource.ParseQuantity("75M")
 	reqCPU, _ := resource.ParseQuantity(instrRules.InjectionRules.ResourceReservation.CPU)
@@ -255,25 +214,16 @@ func addNginxApplicationContainerCloneAsInit(pod corev1.Pod, instrRules *v1alpha
 		"export NGINX_VERSION=$( { nginx -v ; } 2>&1 ) && " +
 		"echo ${NGINX_VERSION##*/} > " + OTEL_WEBSERVER_CONFIG_DIR + "/version.txt"}
 
-	patchOps = append(patchOps, patchOperation{
-		Op:    "add",
-		Path:  "/spec/initContainers/-",
-		Value: initContainerSpec,
-	})
-	return patchOps
+	addInitContainer(pod, *initContainerSpec)
 }
 
-func dropNginxPassedConfig(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerId int) []patchOperation {
-	patchOps := []patchOperation{}
-
-	for idx, volume := range pod.Spec.Containers[containerId].VolumeMounts {
+func dropNginxPassedConfig(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerId int) {
+	volumeMounts := []corev1.VolumeMount{}
+	for _, volume := range pod.Spec.Containers[containerId].VolumeMounts {
 		if strings.Contains(volume.MountPath, "/etc/nginx") { // potentially passes config, which we want to pass to init copy only
-			patchOps = append(patchOps, patchOperation{
-				Op:   "remove",
-				Path: fmt.Sprintf("/spec/containers/%d/volumeMounts/%d", containerId, idx),
-			})
+			continue
 		}
+		volumeMounts = append(volumeMounts, volume)
 	}
-
-	return patchOps
+	pod.Spec.Containers[containerId].VolumeMounts = volumeMounts
 }
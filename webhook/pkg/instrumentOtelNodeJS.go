@@ -25,20 +25,18 @@ import (
 	"k8s.io/apimachinery/pkg/api/resource"
 )
 
-func nodejsOtelInstrumentation(pod corev1.Pod, instrRule *v1alpha1.InstrumentationSpec) []patchOperation {
-	patchOps := []patchOperation{}
+func nodejsOtelInstrumentation(pod *corev1.Pod, instrRule *v1alpha1.InstrumentationSpec, containerIdx int) {
+	addOtelNodejsEnvVar(pod, instrRule, containerIdx)
+	addContainerEnvVar(pod, "OTEL_SERVICE_NAMESPACE", getApplicationName(pod, instrRule), containerIdx)
+	addContainerEnvVar(pod, "OTEL_SERVICE_NAME", getTierName(pod, instrRule), containerIdx)
 
-	patchOps = append(patchOps, addOtelNodejsEnvVar(pod, instrRule, 0)...)
-	patchOps = append(patchOps, addContainerEnvVar("OTEL_SERVICE_NAMESPACE", getApplicationName(pod, instrRule), 0))
-	patchOps = append(patchOps, addContainerEnvVar("OTEL_SERVICE_NAME", getTierName(pod, instrRule), 0))
+	addSpecifiedContainerEnvVars(pod, instrRule.InjectionRules.EnvVars, containerIdx)
 
-	patchOps = append(patchOps, addSpecifiedContainerEnvVars(instrRule.InjectionRules.EnvVars, 0)...)
+	addOtelNodejsAgentVolumeMount(pod, instrRule, containerIdx)
 
-	patchOps = append(patchOps, addOtelNodejsAgentVolumeMount(pod, instrRule, 0)...)
+	addOtelNodejsAgentInitContainer(pod, instrRule)
 
-	patchOps = append(patchOps, addOtelNodejsAgentInitContainer(pod, instrRule)...)
-
-	patchOps = append(patchOps, addOtelNodejsAgentVolume(pod, instrRule)...)
+	addOtelNodejsAgentVolume(pod, instrRule)
 
 	if instrRule.InjectionRules.OpenTelemetryCollector != "" {
 		otelCollConfig, _, err := getCollectorConfigsByName(pod.GetNamespace(), instrRule.InjectionRules.OpenTelemetryCollector)
@@ -47,82 +45,59 @@ func nodejsOtelInstrumentation(pod corev1.Pod, instrRule *v1alpha1.Instrumentati
 			log.Printf("Cannot find OTel collector definition %s\n", instrRule.InjectionRules.OpenTelemetryCollector)
 		} else {
 			if otelCollConfig.Mode == "sidecar" {
-				patchOps = append(patchOps, addContainerEnvVar("OTEL_EXPORTER_OTLP_ENDPOINT", "http://localhost:4317", 0))
-				patchOps = append(patchOps, addOtelCollSidecar(pod, instrRule, 0)...)
+				addContainerEnvVar(pod, "OTEL_EXPORTER_OTLP_ENDPOINT", "http://localhost:4317", containerIdx)
+				addOtelCollSidecar(pod, instrRule, containerIdx)
 			} else if (otelCollConfig.Mode == "deployment") || (otelCollConfig.Mode == "external") {
-				patchOps = append(patchOps, addContainerEnvVar("OTEL_EXPORTER_OTLP_ENDPOINT", fmt.Sprintf("http://%s:4317", otelCollConfig.ServiceName), 0))
+				addContainerEnvVar(pod, "OTEL_EXPORTER_OTLP_ENDPOINT", fmt.Sprintf("http://%s:4317", otelCollConfig.ServiceName), containerIdx)
 			}
 		}
 	}
-	return patchOps
 }
 
-func addOtelNodejsEnvVar(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerIdx int) []patchOperation {
-	patchOps := []patchOperation{}
-
-	patchOps = append(patchOps, addContainerEnvVar("NODE_OPTIONS", "--require /opt/opentelemetry-agent/shim.js", 0))
-
-	return patchOps
+func addOtelNodejsEnvVar(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerIdx int) {
+	addContainerEnvVar(pod, "NODE_OPTIONS", "--require /opt/opentelemetry-agent/shim.js", containerIdx)
 }
 
-func addOtelNodejsAgentVolumeMount(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerIdx int) []patchOperation {
-	patchOps := []patchOperation{}
-	patchOps = append(patchOps, patchOperation{
-		Op:   "add",
-		Path: fmt.Sprintf("/spec/containers/%d/volumeMounts/-", containerIdx),
-		Value: corev1.VolumeMount{
-			MountPath: "/opt/opentelemetry-agent", //TODO
-			Name:      "otel-agent-repo-nodejs",   //TODO
-		},
+func addOtelNodejsAgentVolumeMount(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerIdx int) {
+	addContainerVolumeMount(pod, containerIdx, corev1.VolumeMount{
+		MountPath: "/opt/opentelemetry-agent", //TODO
+		Name:      "otel-agent-repo-nodejs",   //TODO
 	})
-	return patchOps
 }
 
-func addOtelNodejsAgentVolume(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) []patchOperation {
-	patchOps := []patchOperation{}
-	patchOps = append(patchOps, patchOperation{
-		Op:   "add",
-		Path: "/spec/volumes/-",
-		Value: corev1.Volume{
-			Name: "otel-agent-repo-nodejs", //TODO
-			VolumeSource: corev1.VolumeSource{
-				EmptyDir: &corev1.EmptyDirVolumeSource{},
-			},
+func addOtelNodejsAgentVolume(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) {
+	addVolume(pod, corev1.Volume{
+		Name: "otel-agent-repo-nodejs", //TODO
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{},
 		},
 	})
-	return patchOps
 }
 
-func addOtelNodejsAgentInitContainer(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) []patchOperation {
-	patchOps := []patchOperation{}
+func addOtelNodejsAgentInitContainer(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) {
 	limCPU, _ := resource.ParseQuantity("200m")
 	limMem, _ := resource.ParseQuantity("75M")
 	reqCPU, _ := resource.ParseQuantity(instrRules.InjectionRules.ResourceReservation.CPU)
 	reqMem, _ := resource.ParseQuantity(instrRules.InjectionRules.ResourceReservation.Memory)
 
-	patchOps = append(patchOps, patchOperation{
-		Op:   "add",
-		Path: "/spec/initContainers/-",
-		Value: corev1.Container{
-			Name:            "otel-agent-attach-nodejs", //TODO
-			Image:           instrRules.InjectionRules.Image,
-			Command:         []string{"cp", "-r", "/opt/opentelemetry/.", "/opt/opentelemetry-agent"},
-			ImagePullPolicy: corev1.PullAlways, //TODO
-			Resources: corev1.ResourceRequirements{
-				Limits: corev1.ResourceList{
-					corev1.ResourceCPU:    limCPU,
-					corev1.ResourceMemory: limMem,
-				},
-				Requests: corev1.ResourceList{
-					corev1.ResourceCPU:    reqCPU,
-					corev1.ResourceMemory: reqMem,
-				},
+	addInitContainer(pod, corev1.Container{
+		Name:            "otel-agent-attach-nodejs", //TODO
+		Image:           instrRules.InjectionRules.Image,
+		Command:         []string{"cp", "-r", "/opt/opentelemetry/.", "/opt/opentelemetry-agent"},
+		ImagePullPolicy: corev1.PullAlways, //TODO
+		Resources: corev1.ResourceRequirements{
+			Limits: corev1.ResourceList{
+				corev1.ResourceCPU:    limCPU,
+				corev1.ResourceMemory: limMem,
+			},
+			Requests: corev1.ResourceList{
+				corev1.ResourceCPU:    reqCPU,
+				corev1.ResourceMemory: reqMem,
 			},
-			VolumeMounts: []corev1.VolumeMount{{
-				MountPath: "/opt/opentelemetry-agent", //TODO
-				Name:      "otel-agent-repo-nodejs",   //TODO
-			}},
 		},
+		VolumeMounts: []corev1.VolumeMount{{
+			MountPath: "/opt/opentelemetry-agent", //TODO
+			Name:      "otel-agent-repo-nodejs",   //TODO
+		}},
 	})
-	return patchOps
 }
@@ -25,22 +25,20 @@ import (
 	"k8s.io/apimachinery/pkg/api/resource"
 )
 
-func javaSplunkInstrumentation(pod corev1.Pod, instrRule *v1alpha1.InstrumentationSpec) []patchOperation {
-	patchOps := []patchOperation{}
+func javaSplunkInstrumentation(pod *corev1.Pod, instrRule *v1alpha1.InstrumentationSpec, containerIdx int) {
+	addOtelJavaEnvVar(pod, instrRule, containerIdx)
+	addContainerEnvVar(pod, "OTEL_TRACES_EXPORTER", "otlp", containerIdx)
+	addContainerEnvVar(pod, "OTEL_RESOURCE_ATTRIBUTES",
+		fmt.Sprintf("service.name=%s,service.namespace=%s", getTierName(pod, instrRule), getApplicationName(pod, instrRule)), containerIdx)
+	addContainerEnvVar(pod, "OTEL_SERVICE_NAME", getTierName(pod, instrRule), containerIdx)
 
-	patchOps = append(patchOps, addOtelJavaEnvVar(pod, instrRule, 0)...)
-	patchOps = append(patchOps, addContainerEnvVar("OTEL_TRACES_EXPORTER", "otlp", 0))
-	patchOps = append(patchOps, addContainerEnvVar("OTEL_RESOURCE_ATTRIBUTES",
-		fmt.Sprintf("service.name=%s,service.namespace=%s", getTierName(pod, instrRule), getApplicationName(pod, instrRule)), 0))
-	patchOps = append(patchOps, addContainerEnvVar("OTEL_SERVICE_NAME", getTierName(pod, instrRule), 0))
+	addSpecifiedContainerEnvVars(pod, instrRule.InjectionRules.EnvVars, containerIdx)
 
-	patchOps = append(patchOps, addSpecifiedContainerEnvVars(instrRule.InjectionRules.EnvVars, 0)...)
+	addOtelJavaAgentVolumeMount(pod, instrRule, containerIdx)
 
-	patchOps = append(patchOps, addOtelJavaAgentVolumeMount(pod, instrRule, 0)...)
+	addOtelJavaAgentInitContainer(pod, instrRule)
 
-	patchOps = append(patchOps, addOtelJavaAgentInitContainer(pod, instrRule)...)
-
-	patchOps = append(patchOps, addOtelJavaAgentVolume(pod, instrRule)...)
+	addOtelJavaAgentVolume(pod, instrRule)
 
 	if instrRule.InjectionRules.OpenTelemetryCollector != "" {
 		otelCollConfig, _, err := getCollectorConfigsByName(pod.GetNamespace(), instrRule.InjectionRules.OpenTelemetryCollector)
@@ -49,33 +47,23 @@ func javaSplunkInstrumentation(pod corev1.Pod, instrRule *v1alpha1.Instrumentati
 			log.Printf("Cannot find OTel collector definition %s\n", instrRule.InjectionRules.OpenTelemetryCollector)
 		} else {
 			if otelCollConfig.Mode == "sidecar" {
-				patchOps = append(patchOps, addContainerEnvVar("OTEL_EXPORTER_OTLP_ENDPOINT", "http://localhost:4317", 0))
-				patchOps = append(patchOps, addOtelCollSidecar(pod, instrRule, 0)...)
+				addContainerEnvVar(pod, "OTEL_EXPORTER_OTLP_ENDPOINT", "http://localhost:4317", containerIdx)
+				addOtelCollSidecar(pod, instrRule, containerIdx)
 			} else if (otelCollConfig.Mode == "deployment") || (otelCollConfig.Mode == "external") {
-				patchOps = append(patchOps, addContainerEnvVar("OTEL_EXPORTER_OTLP_ENDPOINT", fmt.Sprintf("http://%s:4317", otelCollConfig.ServiceName), 0))
+				addContainerEnvVar(pod, "OTEL_EXPORTER_OTLP_ENDPOINT", fmt.Sprintf("http://%s:4317", otelCollConfig.ServiceName), containerIdx)
 			}
 		}
 	}
-
-	return patchOps
 }
 
-func addSplunkJavaEnvVar(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerIdx int) []patchOperation {
-	patchOps := []patchOperation{}
-
-	patchOps = append(patchOps, patchOperation{
-		Op:   "add",
-		Path: fmt.Sprintf("/spec/containers/%d/env/-", containerIdx),
-		Value: corev1.EnvVar{
-			Name:  instrRules.InjectionRules.JavaEnvVar,
-			Value: getOtelJavaOptions(pod, instrRules),
-		},
+func addSplunkJavaEnvVar(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerIdx int) {
+	addContainerEnv(pod, containerIdx, corev1.EnvVar{
+		Name:  instrRules.InjectionRules.JavaEnvVar,
+		Value: getOtelJavaOptions(pod, instrRules),
 	})
-
-	return patchOps
 }
 
-func getSplunkJavaOptions(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) string {
+func getSplunkJavaOptions(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) string {
 	javaOpts := " "
 
 	if config.ControllerConfig.UseProxy {
@@ -89,64 +77,46 @@ func getSplunkJavaOptions(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSp
 	return javaOpts
 }
 
-func addSplunkJavaAgentVolumeMount(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerIdx int) []patchOperation {
-	patchOps := []patchOperation{}
-	patchOps = append(patchOps, patchOperation{
-		Op:   "add",
-		Path: fmt.Sprintf("/spec/containers/%d/volumeMounts/-", containerIdx),
-		Value: corev1.VolumeMount{
-			MountPath: "/opt/splunk-agent",      //TODO
-			Name:      "splunk-agent-repo-java", //TODO
-		},
+func addSplunkJavaAgentVolumeMount(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerIdx int) {
+	addContainerVolumeMount(pod, containerIdx, corev1.VolumeMount{
+		MountPath: "/opt/splunk-agent",      //TODO
+		Name:      "splunk-agent-repo-java", //TODO
 	})
-	return patchOps
 }
 
-func addSplunkJavaAgentVolume(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) []patchOperation {
-	patchOps := []patchOperation{}
-	patchOps = append(patchOps, patchOperation{
-		Op:   "add",
-		Path: "/spec/volumes/-",
-		Value: corev1.Volume{
-			Name: "splunk-agent-repo-java", //TODO
-			VolumeSource: corev1.VolumeSource{
-				EmptyDir: &corev1.EmptyDirVolumeSource{},
-			},
+func addSplunkJavaAgentVolume(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) {
+	addVolume(pod, corev1.Volume{
+		Name: "splunk-agent-repo-java", //TODO
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{},
 		},
 	})
-	return patchOps
 }
 
-func addSplunkJavaAgentInitContainer(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) []patchOperation {
-	patchOps := []patchOperation{}
+func addSplunkJavaAgentInitContainer(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec) {
 	limCPU, _ := resource.ParseQuantity("200m")
 	limMem, _ := resource.ParseQuantity("75M")
 	reqCPU, _ := resource.ParseQuantity(instrRules.InjectionRules.ResourceReservation.CPU)
 	reqMem, _ := resource.ParseQuantity(instrRules.InjectionRules.ResourceReservation.Memory)
 
-	patchOps = append(patchOps, patchOperation{
-		Op:   "add",
-		Path: "/spec/initContainers/-",
-		Value: corev1.Container{
-			Name:            "splunk-agent-attach-java", //TODO
-			Image:           instrRules.InjectionRules.Image,
-			Command:         []string{"cp", "-r", "/opt/splunk/.", "/opt/splunk-agent"},
-			ImagePullPolicy: corev1.PullAlways, //TODO
-			Resources: corev1.ResourceRequirements{
-				Limits: corev1.ResourceList{
-					corev1.ResourceCPU:    limCPU,
-					corev1.ResourceMemory: limMem,
-				},
-				Requests: corev1.ResourceList{
-					corev1.ResourceCPU:    reqCPU,
-					corev1.ResourceMemory: reqMem,
-				},
+	addInitContainer(pod, corev1.Container{
+		Name:            "splunk-agent-attach-java", //TODO
+		Image:           instrRules.InjectionRules.Image,
+		Command:         []string{"cp", "-r", "/opt/splunk/.", "/opt/splunk-agent"},
+		ImagePullPolicy: corev1.PullAlways, //TODO
+		Resources: corev1.ResourceRequirements{
+			Limits: corev1.ResourceList{
+				corev1.ResourceCPU:    limCPU,
+				corev1.ResourceMemory: limMem,
+			},
+			Requests: corev1.ResourceList{
+				corev1.ResourceCPU:    reqCPU,
+				corev1.ResourceMemory: reqMem,
 			},
-			VolumeMounts: []corev1.VolumeMount{{
-				MountPath: "/opt/splunk-agent",      //TODO
-				Name:      "splunk-agent-repo-java", //TODO
-			}},
 		},
+		VolumeMounts: []corev1.VolumeMount{{
+			MountPath: "/opt/splunk-agent",      //TODO
+			Name:      "splunk-agent-repo-java", //TODO
+		}},
 	})
-	return patchOps
 }
@@ -17,17 +17,19 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net/http"
-	"path/filepath"
+	"os"
 	v1alpha1 "v1alpha1"
 
-	admission "k8s.io/api/admission/v1beta1"
+	admission "k8s.io/api/admission/v1"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 )
@@ -62,15 +64,12 @@ var (
 	otelCollResource    = metav1.GroupVersionResource{Version: "v1alpha1", Resource: "opentelemetrycollectors", Group: "ext.appd.com"}
 )
 
-func handleInstrumentationCRDs(req *admission.AdmissionRequest) ([]patchOperation, error) {
-	if req.DryRun != nil {
-		if *req.DryRun {
-			return []patchOperation{}, nil
-		}
-	}
-
+// handleInstrumentationCRDs only validates the instrumentation CRDs. Rules and collectors are registered by the
+// reconcilers from the watch events, so every replica ends up with the same view regardless of which one
+// served the admission, and objects which never get persisted are never registered.
+func handleInstrumentationCRDs(req *admission.AdmissionRequest, resp *admission.AdmissionResponse) ([]patchOperation, error) {
 	if req.Resource == nsInstrResource {
-		log.Log.Info("Validating and registering namespaced instrumentation", "namespace", req.Namespace, "name", req.Name)
+		log.Log.Info("Validating namespaced instrumentation", "namespace", req.Namespace, "name", req.Name)
 		// Parse the Instrumentation object.
 		raw := req.Object.Raw
 		instr := v1alpha1.Instrumentation{}
@@ -78,11 +77,13 @@ func handleInstrumentationCRDs(req *admission.AdmissionRequest) ([]patchOperatio
 			return nil, fmt.Errorf("could not deserialize Instrumentation object: %v", err)
 		}
 
-		injectionRuleDefaults(instr.Spec.InjectionRules)
-		upsertCrdInstrumentation(req.Namespace, instr.Name, instr.Spec)
+		errs, warnings := validateInstrumentationSpec(&instr.Spec, req.Namespace, field.NewPath("spec"))
+		if err := admitValidation(resp, errs, warnings); err != nil {
+			return nil, err
+		}
 
 	} else if req.Resource == globalInstrResource {
-		log.Log.Info("Validating and registering cluster-wide instrumentation", "name", req.Name)
+		log.Log.Info("Validating cluster-wide instrumentation", "name", req.Name)
 		// Parse the GlobalInstrumentation object.
 		raw := req.Object.Raw
 		instr := v1alpha1.ClusterInstrumentation{}
@@ -90,11 +91,13 @@ func handleInstrumentationCRDs(req *admission.AdmissionRequest) ([]patchOperatio
 			return nil, fmt.Errorf("could not deserialize ClusterInstrumentation object: %v", err)
 		}
 
-		injectionRuleDefaults(instr.Spec.InjectionRules)
-		upsertCrdClusterInstrumentation(instr.Name, instr.Spec)
+		errs, warnings := validateInstrumentationSpec(&instr.Spec, "", field.NewPath("spec"))
+		if err := admitValidation(resp, errs, warnings); err != nil {
+			return nil, err
+		}
 
 	} else if req.Resource == otelCollResource {
-		log.Log.Info("Validating and registering OpenTelemetry collector", "namespace", req.Namespace, "name", req.Name)
+		log.Log.Info("Validating OpenTelemetry collector", "namespace", req.Namespace, "name", req.Name)
 		// Parse the OpenTelemetryCollector object.
 		raw := req.Object.Raw
 		otelcol := v1alpha1.OpenTelemetryCollector{}
@@ -102,25 +105,29 @@ func handleInstrumentationCRDs(req *admission.AdmissionRequest) ([]patchOperatio
 			return nil, fmt.Errorf("could not deserialize OpenTelemetryCollector object: %v", err)
 		}
 
-		// if sidecar definition, which is only config as such, register it for later use
-		// when instrumented pods are instatiated
-		if otelcol.Spec.Mode == v1alpha1.ModeSidecar {
-			registerNamespacedSidecarCollector(req.Namespace, &otelcol)
-		} else {
-			// now it get's tricky - we'll leave collector instantiation for controller reconciler and just register
-			// the definition for immediate pod use
-			registerNamespacedStandaloneCollector(req.Namespace, &otelcol)
+		errs, warnings := validateOtelCollectorSpec(&otelcol.Spec, field.NewPath("spec"))
+		if err := admitValidation(resp, errs, warnings); err != nil {
+			return nil, err
 		}
-
 	}
 
-	// TODO - for each type, reconciler should be added to check if in say 10 seconds, resource was really persisted
-	// and if not, removed from instrumentation rules
-
 	return []patchOperation{}, nil
 }
 
-func applyAppdInstrumentation(req *admission.AdmissionRequest) ([]patchOperation, error) {
+// admitValidation turns the result of a validation into admission warnings and, if there are any
+// errors, into the error denying the request
+func admitValidation(resp *admission.AdmissionResponse, errs field.ErrorList, warnings []string) error {
+	for _, warning := range warnings {
+		addWarning(resp, "%s", warning)
+	}
+	if len(errs) > 0 {
+		log.Log.Info("Validation failed", "errors", errs.ToAggregate().Error())
+		return errs.ToAggregate()
+	}
+	return nil
+}
+
+func applyAppdInstrumentation(req *admission.AdmissionRequest, resp *admission.AdmissionResponse) ([]patchOperation, error) {
 	// This handler should only get called on Pod objects as per the MutatingWebhookConfiguration in the YAML file.
 	// However, if (for whatever reason) this gets invoked on an object of a different kind, issue a log message but
 	// let the object request pass through otherwise.
@@ -130,6 +137,7 @@ func applyAppdInstrumentation(req *admission.AdmissionRequest) ([]patchOperation
 
 	if req.Resource != podResource {
 		log.Log.Info("expect resource to be", "pod", podResource)
+		admissionsTotal.WithLabelValues(ADMISSION_RESULT_SKIPPED).Inc()
 		return nil, nil
 	}
 
@@ -137,6 +145,7 @@ func applyAppdInstrumentation(req *admission.AdmissionRequest) ([]patchOperation
 	raw := req.Object.Raw
 	pod := corev1.Pod{}
 	if _, _, err := universalDeserializer.Decode(raw, nil, &pod); err != nil {
+		admissionsTotal.WithLabelValues(ADMISSION_RESULT_FAILED).Inc()
 		return nil, fmt.Errorf("could not deserialize pod object: %v", err)
 	}
 
@@ -151,17 +160,28 @@ func applyAppdInstrumentation(req *admission.AdmissionRequest) ([]patchOperation
 
 	// Check if we have configuration sucessfully
 	if config.ControllerConfig == nil || config.InstrumentationConfig == nil {
+		admissionsTotal.WithLabelValues(ADMISSION_RESULT_FAILED).Inc()
 		return nil, fmt.Errorf("instrumentor configuration not read from configmap")
 	}
 
+	// a pod admitted again must come out identical, so instrumentation is never applied twice
+	if reason := alreadyInstrumented(pod); reason != "" {
+		log.Log.Info("Pod already instrumented, skipping", "pod", pod.Name, "reason", reason)
+		admissionsTotal.WithLabelValues(ADMISSION_RESULT_SKIPPED).Inc()
+		return []patchOperation{}, nil
+	}
+
 	log.Log.Info("Checking instrumentation for", "pod", pod.Name)
-	instrumentationRule := getInstrumentationRule(pod)
+	instrumentationRule, ruleSource := getInstrumentationRule(pod, isDryRun(req))
 
 	if instrumentationRule == nil { // pod not eligible for AppDynamics instrumentation
+		admissionsTotal.WithLabelValues(ADMISSION_RESULT_SKIPPED).Inc()
 		return []patchOperation{}, nil
 	}
 
-	log.Log.Info("Found instrumentation rule", "rule", instrumentationRule.Name)
+	log.Log.Info("Found instrumentation rule", "rule", instrumentationRule.Name, "source", ruleSource)
+	addAuditAnnotation(resp, "instrumentation-rule", instrumentationRule.Name)
+	ruleMatchesTotal.WithLabelValues(instrumentationRule.Name, ruleSource).Inc()
 
 	config.mutex.Lock()
 	defer config.mutex.Unlock()
@@ -170,11 +190,42 @@ func applyAppdInstrumentation(req *admission.AdmissionRequest) ([]patchOperation
 	// but we need it. since this does not get propagated anywhere
 	// it's supplied here into the pod data
 	pod.Namespace = req.Namespace
-	patches, err := instrument(pod, instrumentationRule)
+	patches, outcomes, err := instrument(pod, instrumentationRule)
+	if err != nil {
+		admissionsTotal.WithLabelValues(ADMISSION_RESULT_FAILED).Inc()
+		return patches, err
+	}
+
+	for _, outcome := range outcomes {
+		technology, provider := getTechnologyAndProvider(outcome.Technology)
+		injectionsTotal.WithLabelValues(technology, provider).Inc()
+	}
+
+	// resolving the owner may take an API call, do not hold the admission for it.
+	// dry-run admissions must not have side effects, so no events are recorded for them
+	if !isDryRun(req) {
+		go recordInstrumentationEvents(pod, &instrumentationRule.InstrumentationSpec, outcomes)
+	}
+
+	if injectionFailed(outcomes) {
+		if instrumentationRule.FailurePolicy == v1alpha1.FailurePolicyFail {
+			admissionsTotal.WithLabelValues(ADMISSION_RESULT_DENIED).Inc()
+			return nil, fmt.Errorf("pod denied by instrumentation rule %s with failure policy %s: %s",
+				instrumentationRule.Name, instrumentationRule.FailurePolicy, injectionFailures(outcomes))
+		}
+		admissionsTotal.WithLabelValues(ADMISSION_RESULT_FAILED).Inc()
+	} else {
+		admissionsTotal.WithLabelValues(ADMISSION_RESULT_INSTRUMENTED).Inc()
+	}
+	countPatchOperations(patches)
 
 	return patches, err
 }
 
+func isDryRun(req *admission.AdmissionRequest) bool {
+	return req.DryRun != nil && *req.DryRun
+}
+
 func main() {
 
 	otelTracing := flag.Bool("otel-tracing", false, "set to true to otel traces enabled")
@@ -183,6 +234,13 @@ func main() {
 	otelLogPayload := flag.Bool("otel-log-layload", false, "set to true if payload attached to traces as attribute")
 	otelServiceName := flag.String("otel-service-name", "mwh", "service name")
 	otelServiceNamespace := flag.String("otel-service-namespace", "default", "service namespace")
+	tlsSelfManaged := flag.Bool("tls-self-managed", false, "set to true to create and rotate the serving certificate in a secret instead of reading it from "+tlsDir)
+	tlsSecretName := flag.String("tls-secret-name", "webhook-instrumentor-self-managed-certs", "secret holding the self-managed serving certificate, must differ from the secret provisioned by the helm chart")
+	tlsServiceName := flag.String("tls-service-name", "webhook-instrumentor", "name of the webhook service the serving certificate is issued for")
+	tlsWebhookName := flag.String("tls-webhook-name", "webhook-appd", "name of the MutatingWebhookConfiguration to patch the CA bundle of")
+	tlsValidityDays := flag.Int("tls-validity-days", 365, "validity of the self-managed serving certificate in days")
+	leaderElect := flag.Bool("leader-elect", true, "set to false to reconcile CRDs and collectors on every replica instead of the elected leader only")
+	leaderElectionID := flag.String("leader-election-id", "webhook-instrumentor-leader", "name of the lease used for leader election")
 	flag.Parse()
 
 	otelConfig = OtelConfig{
@@ -209,25 +267,46 @@ func main() {
 	// select {}
 	// return
 
-	certPath := filepath.Join(tlsDir, tlsCertFile)
-	keyPath := filepath.Join(tlsDir, tlsKeyFile)
-
 	tracer := getTracer("webhook-tracer")
 	log.Log.Info("Otel Tracer", "tracer", tracer)
 
-	go startCrdReconciler()
+	go startCrdReconciler(ReconcilerConfig{
+		LeaderElect:      *leaderElect,
+		LeaderElectionID: *leaderElectionID,
+		Namespace:        getMyNamespace(),
+	})
 
 	mux := http.NewServeMux()
 
-	mux.Handle("/mutate", otelHandler(admitFuncHandler(applyAppdInstrumentation), "/mutate"))
-	mux.Handle("/validate", otelHandler(admitFuncHandler(handleInstrumentationCRDs), "/validate"))
+	mux.Handle("/mutate", metricsHandler(otelHandler(admitFuncHandler(applyAppdInstrumentation), "/mutate"), "/mutate"))
+	mux.Handle("/validate", metricsHandler(otelHandler(admitFuncHandler(handleInstrumentationCRDs), "/validate"), "/validate"))
 	mux.Handle("/api/config", otelHandler(configHandler(), "/api/config"))
+	mux.Handle("/api/preview", otelHandler(previewHandler(), "/api/preview"))
+	mux.Handle("/api/explain", otelHandler(explainHandler(), "/api/explain"))
+	registerHealthHandlers(mux)
+	registerMetricsHandler(mux)
+
+	tlsConfig, err := initServingCertificates(context.Background(), CertConfig{
+		SelfManaged:  *tlsSelfManaged,
+		Namespace:    getMyNamespace(),
+		SecretName:   *tlsSecretName,
+		ServiceName:  *tlsServiceName,
+		WebhookName:  *tlsWebhookName,
+		ValidityDays: *tlsValidityDays,
+	})
+	if err != nil {
+		log.Log.Error(err, "cannot set up serving certificate")
+		os.Exit(1)
+	}
+
 	server := &http.Server{
 		// We listen on port 8443 such that we do not need root privileges or extra capabilities for this server.
 		// The Service object will take care of mapping this port to the HTTPS port 443.
-		Addr:    ":8443",
-		Handler: mux,
+		Addr:      ":8443",
+		Handler:   mux,
+		TLSConfig: tlsConfig,
 	}
-	err := server.ListenAndServeTLS(certPath, keyPath)
+	// certificate and key are provided by TLSConfig.GetCertificate, so they can change without a restart
+	err = server.ListenAndServeTLS("", "")
 	log.Log.Error(err, "never should get here")
 }
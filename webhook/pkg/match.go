@@ -20,119 +20,282 @@ import (
 	"bytes"
 	"fmt"
 	"log"
-	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 	"text/template"
 	"v1alpha1"
 
 	corev1 "k8s.io/api/core/v1"
 )
 
-func getFlexMatch(pod corev1.Pod, flexMatchTmpl *template.Template) string {
+// pod annotation opting the pod out of instrumentation by any rule
+const SKIP_INSTRUMENTATION_ANNOTATION = "instrumentation.ext.appd.com/skip"
+
+// name prefix of rules created from injection templates selected by flex match
+const FLEX_MATCH_RULE_PREFIX = "*flexmatch*/"
+
+func getFlexMatch(pod corev1.Pod, flexMatchTmpl *template.Template) (string, error) {
 
 	var res bytes.Buffer
 	err := flexMatchTmpl.Execute(&res, pod)
 	if err != nil {
-		log.Printf("Error executing flex match %s: %v\n", flexMatchTmpl.Name(), err)
-		return ""
+		return "", fmt.Errorf("error executing flex match %s: %v", flexMatchTmpl.Name(), err)
 	}
 
 	log.Printf("Pod: %s, %s, Flex Match Result: %s\n", pod.Name, pod.GetName(), res.String())
-	return res.String()
+	return strings.TrimSpace(res.String()), nil
 }
 
-func isMatch(pod corev1.Pod, rules v1alpha1.MatchRule) bool {
+// getFlexMatchRule selects the rule by the output of the flex match template, which is either a name of
+// instrumentation rule of any source, or a name of injection template. Empty output means the pod is not
+// to be instrumented. Returns false when the output names neither, then rules are matched as usual.
+func getFlexMatchRule(pod corev1.Pod) (*InstrumentationRule, string, bool) {
+	flexMatch, err := getFlexMatch(pod, config.FlexMatchTemplate)
+	if err != nil {
+		log.Printf("Flex match failed for pod %s, matching rules: %v\n", pod.GetName(), err)
+		return nil, "", false
+	}
 
-	if rules.NamespaceRegex != "" {
-		match, _ := regexp.MatchString(rules.NamespaceRegex, pod.GetNamespace())
-		if !match {
-			fmt.Printf("Namespace regex '%s' did not match %s\n", rules.NamespaceRegex, pod.GetNamespace())
-			return false
-		}
+	if flexMatch == "" {
+		log.Printf("Flex match selected no instrumentation for pod %s\n", pod.GetName())
+		return nil, "", true
 	}
-	if rules.PodNameRegex != "" {
-		match, _ := regexp.MatchString(rules.PodNameRegex, pod.GetName())
-		if !match {
-			return false
-		}
+
+	if rule, ruleSource := findInstrumentationRule(pod.GetNamespace(), flexMatch); rule != nil {
+		log.Printf("Flex match selected %s rule %s for pod %s\n", ruleSource, rule.Name, pod.GetName())
+		return rule, ruleSource, true
 	}
-	if rules.Annotations != nil {
-		for _, annotRule := range *rules.Annotations {
-			for annot, regex := range annotRule {
-				// lookup rule annotation name in pod. If not found, return false. If found, check regex
-				podAnnots := pod.GetAnnotations()
-				podAnnotVal, found := podAnnots[annot]
-				if !found {
-					return false
-				}
-				match, _ := regexp.MatchString(regex, podAnnotVal)
-				if !match {
-					return false
+
+	if config.InjectionTemplates != nil {
+		for _, injTemplate := range *config.InjectionTemplates {
+			if injTemplate.Name == flexMatch && injTemplate.InjectionRules != nil {
+				log.Printf("Flex match selected injection template %s for pod %s\n", injTemplate.Name, pod.GetName())
+				injRules := injectionRuleTemplate(&v1alpha1.InjectionRule{Template: injTemplate.Name}, injTemplate.InjectionRules.DeepCopy())
+				rule := &InstrumentationRule{
+					InstrumentationSpec: v1alpha1.InstrumentationSpec{
+						Name:           FLEX_MATCH_RULE_PREFIX + injTemplate.Name,
+						MatchRules:     &v1alpha1.MatchRule{},
+						InjectionRules: injectionRuleDefaults(injRules),
+					},
 				}
+				// container selectors of templates are validated when the config is loaded
+				rule.containerSelectors, _ = newContainerSelectors(&rule.InstrumentationSpec)
+				return rule, RULE_SOURCE_FLEX_MATCH, true
 			}
 		}
 	}
-	if rules.Labels != nil {
-		for _, labelRule := range *rules.Labels {
-			for label, regex := range labelRule {
-				// lookup rule annotation name in pod. If not found, return false. If found, check regex
-				podLabels := pod.GetLabels()
-				podLabelVal, found := podLabels[label]
-				if !found {
-					return false
-				}
-				match, _ := regexp.MatchString(regex, podLabelVal)
-				if !match {
-					return false
-				}
+
+	log.Printf("Flex match result %s for pod %s is neither rule nor injection template, matching rules\n", flexMatch, pod.GetName())
+	return nil, "", false
+}
+
+// findInstrumentationRule looks up rule by name in rule sources in the order of RuleSourcePrecedence, names
+// of rules from CRDs are prefixed, see upsertCrdInstrumentation and upsertCrdClusterInstrumentation
+func findInstrumentationRule(namespace string, name string) (*InstrumentationRule, string) {
+	for _, source := range config.RuleSourcePrecedence {
+		instrRules := sourceRules(namespace, source)
+		if instrRules == nil {
+			continue
+		}
+		for i := range *instrRules {
+			if (*instrRules)[i].Name == name {
+				return &(*instrRules)[i], source
 			}
 		}
 	}
-	return true
+	return nil, ""
 }
 
-func getInstrumentationRule(pod corev1.Pod) *v1alpha1.InstrumentationSpec {
+// sourceRules returns rules of the source applicable to the namespace, nil if there are none
+func sourceRules(namespace string, source string) *InstrumentationRules {
+	switch source {
+	case RULE_SOURCE_NAMESPACED_CRD:
+		if !config.CrdsDisabled {
+			return config.InstrumentationNamespacedCrds[namespace]
+		}
+	case RULE_SOURCE_CLUSTER_CRD:
+		return config.InstrumentationClusterCrds
+	case RULE_SOURCE_CONFIGMAP:
+		return config.InstrumentationConfig
+	}
+	return nil
+}
+
+// matchedRule returns a copy of the first matching rule, unless the rule excludes the pod from instrumentation
+// by doNotInstrument. Excluded pods are not checked against any further rule.
+func matchedRule(target *matchTarget, rule *InstrumentationRule, ruleSource string, reason string) (*InstrumentationRule, string) {
+	if rule.InjectionRules != nil && rule.InjectionRules.DoNotInstrument != nil && *rule.InjectionRules.DoNotInstrument {
+		log.Default().Printf("Pod excluded from instrumentation by %s rule %s\n", ruleSource, rule.Name)
+		target.record(rule.Name, ruleSource, RULE_EVALUATION_EXCLUDED, "doNotInstrument")
+		target.decide(fmt.Sprintf("excluded from instrumentation by %s rule %s", ruleSource, rule.Name))
+		return nil, ""
+	}
+	target.record(rule.Name, ruleSource, RULE_EVALUATION_MATCHED, reason)
+	target.decide(fmt.Sprintf("instrumented by %s rule %s", ruleSource, rule.Name))
+	// rule points into the configuration, which may be updated once the lock is released
+	return rule.DeepCopy(), ruleSource
+}
+
+// getInstrumentationRule returns the first rule matching the pod together with the source the rule comes from,
+// or nil if the pod is not to be instrumented. Rule conflicts are reported by events, unless it's a dry run.
+func getInstrumentationRule(pod corev1.Pod, dryRun bool) (*InstrumentationRule, string) {
+	target := newMatchTarget(pod)
+	rule, ruleSource := matchInstrumentationRule(target)
+	for _, conflict := range target.conflicts {
+		ruleConflictsTotal.WithLabelValues(conflict.rule, conflict.conflicting).Inc()
+	}
+	if len(target.conflicts) > 0 && !dryRun {
+		// resolving the event target may take an API call, do not hold the admission for it
+		go recordRuleConflictEvents(pod, target.conflicts)
+	}
+	return rule, ruleSource
+}
+
+// sourcedRule is a rule in the merged list of rules from all sources
+type sourcedRule struct {
+	rule   *InstrumentationRule
+	source string
+}
+
+// ruleConflict is a rule matching the pod with the same priority as the rule which decided
+type ruleConflict struct {
+	rule        string
+	conflicting string
+	priority    int
+}
+
+// orderedRules merges rules applicable to the namespace from all sources. Rules with higher priority
+// come first, rules with equal priority are ordered by RuleSourcePrecedence, then by the order within
+// the source, which is by name for CRDs and as listed for the config map.
+func orderedRules(namespace string) []sourcedRule {
+	rules := []sourcedRule{}
+	for _, source := range config.RuleSourcePrecedence {
+		instrRules := sourceRules(namespace, source)
+		if instrRules == nil {
+			continue
+		}
+		for i := range *instrRules {
+			rules = append(rules, sourcedRule{rule: &(*instrRules)[i], source: source})
+		}
+	}
+
+	// rules of each source are sorted by priority already, stable sort keeps the tie-breaks
+	slices.SortStableFunc(rules, func(a, b sourcedRule) int {
+		return compareRulePriority(*a.rule, *b.rule)
+	})
+	return rules
+}
+
+// ownerNeeded tells whether any of the rules applicable to the namespace refers to the workload owner. Rules
+// may change once the lock is released, the owner is then looked up during matching as a fallback.
+func ownerNeeded(namespace string) bool {
+	config.mutex.Lock()
+	defer config.mutex.Unlock()
+
+	if config.InstrumentationSuspended {
+		return false
+	}
+	for _, source := range config.RuleSourcePrecedence {
+		instrRules := sourceRules(namespace, source)
+		if instrRules == nil {
+			continue
+		}
+		for _, rule := range *instrRules {
+			if rule.matcher.needsOwner {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchInstrumentationRule(target *matchTarget) (*InstrumentationRule, string) {
+	pod := target.pod
+
+	target.resolve()
 
 	config.mutex.Lock()
 	defer config.mutex.Unlock()
 
 	// fmt.Printf("Config: %v\n", config)
 
-	if config.FlexMatchTemplate != nil {
-		getFlexMatch(pod, config.FlexMatchTemplate)
+	if config.InstrumentationSuspended {
+		log.Default().Printf("Instrumentation suspended, pod %s left as is\n", pod.GetName())
+		target.decide("instrumentation suspended by " + SUSPEND_INSTRUMENTATION_CONFIG_KEY + " in the config map")
+		return nil, ""
 	}
 
-	log.Default().Printf("Matching started\n")
+	if skip, _ := strconv.ParseBool(pod.GetAnnotations()[SKIP_INSTRUMENTATION_ANNOTATION]); skip {
+		log.Default().Printf("Pod %s opted out of instrumentation by annotation %s\n", pod.GetName(), SKIP_INSTRUMENTATION_ANNOTATION)
+		target.decide("opted out of instrumentation by annotation " + SKIP_INSTRUMENTATION_ANNOTATION)
+		return nil, ""
+	}
 
-	// First check if pod matches any namespaced Instrumentation - based rule
-	if !config.CrdsDisabled {
-		log.Default().Printf("Checking namespaced rules\n")
-		if instrConfig, ok := config.InstrumentationNamespacedCrds[pod.GetNamespace()]; ok {
-			for _, rule := range *instrConfig {
-				log.Default().Printf("Checking namespaced rule: %s\n", rule.Name)
-				if isMatch(pod, *rule.MatchRules) {
-					return &rule
-				}
+	if config.FlexMatchTemplate != nil {
+		if rule, ruleSource, selected := getFlexMatchRule(pod); selected {
+			if rule == nil {
+				target.decide("flex match selected no instrumentation")
+				return nil, ""
 			}
+			if reason := rule.inactive(target.now); reason != "" {
+				log.Default().Printf("Rule %s selected by flex match skipped: %s\n", rule.Name, reason)
+				target.record(rule.Name, ruleSource, RULE_EVALUATION_INACTIVE, reason)
+				target.decide(fmt.Sprintf("flex match selected %s rule %s, which is %s", ruleSource, rule.Name, reason))
+				return nil, ""
+			}
+			return matchedRule(target, rule, ruleSource, "selected by flex match")
 		}
 	}
 
-	log.Default().Printf("Checking global rules\n")
+	log.Default().Printf("Matching started\n")
 
-	for _, rule := range *config.InstrumentationClusterCrds {
-		log.Default().Printf("Checking cluster-wide rule: %s\n", rule.Name)
-		if isMatch(pod, *rule.MatchRules) {
-			return &rule
+	rules := orderedRules(pod.GetNamespace())
+	for i, candidate := range rules {
+		if ruleMatches(target, candidate.rule, candidate.source) {
+			rule, ruleSource := matchedRule(target, candidate.rule, candidate.source, "")
+			detectRuleConflicts(target, candidate, rules[i+1:])
+			return rule, ruleSource
 		}
 	}
 
-	log.Default().Printf("Checking config map rules\n")
+	target.decide("no rule matched")
+	return nil, ""
+}
 
-	for _, rule := range *config.InstrumentationConfig {
-		log.Default().Printf("Checking config map rule: %s\n", rule.Name)
-		if isMatch(pod, *rule.MatchRules) {
-			return &rule
+// detectRuleConflicts checks rules following the deciding rule with the same priority. Those would have decided,
+// if the tie-breaks were different, so the pod matching them means the rules overlap.
+func detectRuleConflicts(target *matchTarget, decided sourcedRule, following []sourcedRule) {
+	for _, candidate := range following {
+		if candidate.rule.Priority != decided.rule.Priority {
+			return
+		}
+		if candidate.rule.inactive(target.now) == "" && candidate.rule.matcher.matches(target) {
+			log.Default().Printf("Pod %s matches %s rule %s with the same priority %d as %s rule %s\n", target.pod.GetName(),
+				candidate.source, candidate.rule.Name, candidate.rule.Priority, decided.source, decided.rule.Name)
+			target.conflicts = append(target.conflicts, ruleConflict{
+				rule:        decided.rule.Name,
+				conflicting: candidate.rule.Name,
+				priority:    candidate.rule.Priority,
+			})
+			target.record(candidate.rule.Name, candidate.source, RULE_EVALUATION_CONFLICT,
+				fmt.Sprintf("matches with the same priority %d as %s", candidate.rule.Priority, decided.rule.Name))
 		}
 	}
+}
 
-	return nil
+// ruleMatches checks the rule against the target, rules not matching are recorded with the failed criterion
+func ruleMatches(target *matchTarget, rule *InstrumentationRule, ruleSource string) bool {
+	log.Default().Printf("Checking %s rule: %s\n", ruleSource, rule.Name)
+	if reason := rule.inactive(target.now); reason != "" {
+		log.Default().Printf("Rule %s skipped: %s\n", rule.Name, reason)
+		target.record(rule.Name, ruleSource, RULE_EVALUATION_INACTIVE, reason)
+		return false
+	}
+	if reason := rule.matcher.mismatch(target); reason != "" {
+		log.Default().Printf("Rule %s did not match: %s\n", rule.Name, reason)
+		target.record(rule.Name, ruleSource, RULE_EVALUATION_NOT_MATCHED, reason)
+		return false
+	}
+	return true
 }
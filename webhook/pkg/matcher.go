@@ -0,0 +1,381 @@
+/*
+Copyright (c) 2019 Cisco Systems, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"time"
+	"v1alpha1"
+
+	"github.com/google/cel-go/cel"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// InstrumentationRule is an instrumentation rule together with its match rules and container selectors
+// compiled when the rule is loaded, so that admission does not have to parse them again
+type InstrumentationRule struct {
+	v1alpha1.InstrumentationSpec
+	matcher *ruleMatcher
+	// containerSelectors has the selector of each injection rule, see injectionRulesOf, nil where not set
+	containerSelectors []*containerSelector
+}
+
+type InstrumentationRules []InstrumentationRule
+
+// DeepCopy copies the rule out of the configuration, so that it can be used after the configuration lock
+// is released. The matcher and container selectors are not changed once built and are shared.
+func (r *InstrumentationRule) DeepCopy() *InstrumentationRule {
+	return &InstrumentationRule{
+		InstrumentationSpec: *r.InstrumentationSpec.DeepCopy(),
+		matcher:             r.matcher,
+		containerSelectors:  r.containerSelectors,
+	}
+}
+
+// containerSelector returns the compiled container selector of the injection rule at the index
+func (r *InstrumentationRule) containerSelector(idx int) *containerSelector {
+	if idx < len(r.containerSelectors) {
+		return r.containerSelectors[idx]
+	}
+	return nil
+}
+
+// ruleMatcher is the compiled form of v1alpha1.MatchRule
+type ruleMatcher struct {
+	namespaceRegex *regexp.Regexp
+	podNameRegex   *regexp.Regexp
+	labels         []valueMatcher
+	annotations    []valueMatcher
+	// labelSelector from matchLabels and matchExpressions, nil when neither is specified
+	labelSelector labels.Selector
+	// namespaceSelector and namespaceAnnotations are matched against the namespace of the pod
+	namespaceSelector    labels.Selector
+	namespaceAnnotations []valueMatcher
+	// imageRegex matches if any container image matches, the first such container gets instrumented
+	imageRegex *regexp.Regexp
+	// ownerKindRegex and ownerNameRegex are matched against the top-level workload owning the pod
+	ownerKindRegex *regexp.Regexp
+	ownerNameRegex *regexp.Regexp
+	// expression is the compiled CEL expression, evaluated last as the most expensive criterion
+	expression cel.Program
+	// rolloutPercentage limits the rule to a share of pods, nil for all pods
+	rolloutPercentage *int
+	// needsOwner is set when a criterion refers to the workload owner, which takes an API call to look up
+	needsOwner bool
+}
+
+// matchTarget is the pod being matched, with the namespace and workload owner looked up at most once
+// for all the rules evaluated
+type matchTarget struct {
+	pod corev1.Pod
+	// now is the time rules are checked to be active at
+	now time.Time
+
+	namespace         *corev1.Namespace
+	namespaceErr      error
+	namespaceResolved bool
+
+	owner         *metav1.OwnerReference
+	ownerResolved bool
+
+	// trace records evaluation of the rules when explaining the match, nil otherwise
+	trace *matchTrace
+	// conflicts are rules matching with the same priority as the rule which decided
+	conflicts []ruleConflict
+}
+
+func newMatchTarget(pod corev1.Pod) *matchTarget {
+	return &matchTarget{pod: pod, now: time.Now()}
+}
+
+func (t *matchTarget) getNamespace() (*corev1.Namespace, error) {
+	if !t.namespaceResolved {
+		t.namespace, t.namespaceErr = getNamespace(t.pod.GetNamespace())
+		t.namespaceResolved = true
+	}
+	return t.namespace, t.namespaceErr
+}
+
+// resolve looks up the namespace ahead of matching, and the workload owner if any of the rules needs it,
+// so that the API calls they may take are not made while holding the configuration lock
+func (t *matchTarget) resolve() {
+	t.getNamespace()
+	if ownerNeeded(t.pod.GetNamespace()) {
+		t.getOwner()
+	}
+}
+
+func (t *matchTarget) getOwner() *metav1.OwnerReference {
+	if !t.ownerResolved {
+		t.owner = getWorkloadOwner(t.pod)
+		t.ownerResolved = true
+	}
+	return t.owner
+}
+
+// valueMatcher matches value of a label or annotation
+type valueMatcher struct {
+	key   string
+	regex *regexp.Regexp
+}
+
+func newInstrumentationRule(spec v1alpha1.InstrumentationSpec) (InstrumentationRule, error) {
+	if spec.MatchRules == nil {
+		return InstrumentationRule{}, fmt.Errorf("instrumentation rule %s has no match rules", spec.Name)
+	}
+	matcher, err := newRuleMatcher(spec.MatchRules)
+	if err != nil {
+		return InstrumentationRule{}, fmt.Errorf("instrumentation rule %s: %v", spec.Name, err)
+	}
+	if spec.Priority == 0 {
+		spec.Priority = DEFAULT_RULE_PRIORITY
+	}
+	if spec.Rollout != nil {
+		percentage := spec.Rollout.Percentage
+		matcher.rolloutPercentage = &percentage
+		// pods are placed into the rollout by their workload
+		matcher.needsOwner = true
+	}
+	containerSelectors, err := newContainerSelectors(&spec)
+	if err != nil {
+		return InstrumentationRule{}, fmt.Errorf("instrumentation rule %s: %v", spec.Name, err)
+	}
+	return InstrumentationRule{InstrumentationSpec: spec, matcher: matcher, containerSelectors: containerSelectors}, nil
+}
+
+func newInstrumentationRules(instrumentationConfig *InstrumentationConfig) (*InstrumentationRules, error) {
+	rules := InstrumentationRules{}
+	for _, spec := range *instrumentationConfig {
+		rule, err := newInstrumentationRule(spec)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return &rules, nil
+}
+
+func newRuleMatcher(matchRules *v1alpha1.MatchRule) (*ruleMatcher, error) {
+	var err error
+	matcher := &ruleMatcher{}
+
+	if matchRules.NamespaceRegex != "" {
+		if matcher.namespaceRegex, err = regexp.Compile(matchRules.NamespaceRegex); err != nil {
+			return nil, fmt.Errorf("invalid namespaceRegex %q: %v", matchRules.NamespaceRegex, err)
+		}
+	}
+	if matchRules.PodNameRegex != "" {
+		if matcher.podNameRegex, err = regexp.Compile(matchRules.PodNameRegex); err != nil {
+			return nil, fmt.Errorf("invalid podNameRegex %q: %v", matchRules.PodNameRegex, err)
+		}
+	}
+	if matcher.labels, err = newValueMatchers(matchRules.Labels); err != nil {
+		return nil, fmt.Errorf("invalid labels: %v", err)
+	}
+	if matcher.annotations, err = newValueMatchers(matchRules.Annotations); err != nil {
+		return nil, fmt.Errorf("invalid annotations: %v", err)
+	}
+
+	if len(matchRules.MatchLabels) > 0 || len(matchRules.MatchExpressions) > 0 {
+		matcher.labelSelector, err = metav1.LabelSelectorAsSelector(&metav1.LabelSelector{
+			MatchLabels:      matchRules.MatchLabels,
+			MatchExpressions: matchRules.MatchExpressions,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("invalid label selector: %v", err)
+		}
+	}
+
+	if matchRules.NamespaceSelector != nil {
+		if matcher.namespaceSelector, err = metav1.LabelSelectorAsSelector(matchRules.NamespaceSelector); err != nil {
+			return nil, fmt.Errorf("invalid namespaceSelector: %v", err)
+		}
+	}
+	if matcher.namespaceAnnotations, err = newValueMatchers(matchRules.NamespaceAnnotations); err != nil {
+		return nil, fmt.Errorf("invalid namespaceAnnotations: %v", err)
+	}
+
+	if matchRules.ImageRegex != "" {
+		if matcher.imageRegex, err = regexp.Compile(matchRules.ImageRegex); err != nil {
+			return nil, fmt.Errorf("invalid imageRegex %q: %v", matchRules.ImageRegex, err)
+		}
+	}
+	if matchRules.OwnerKind != "" {
+		// kind is matched as a whole, so that Deployment does not match also e.g. DeploymentConfig
+		if matcher.ownerKindRegex, err = regexp.Compile("^(?:" + matchRules.OwnerKind + ")$"); err != nil {
+			return nil, fmt.Errorf("invalid ownerKind %q: %v", matchRules.OwnerKind, err)
+		}
+	}
+	if matchRules.OwnerNameRegex != "" {
+		if matcher.ownerNameRegex, err = regexp.Compile(matchRules.OwnerNameRegex); err != nil {
+			return nil, fmt.Errorf("invalid ownerNameRegex %q: %v", matchRules.OwnerNameRegex, err)
+		}
+	}
+	if matchRules.Expression != "" {
+		var usesOwner bool
+		if matcher.expression, usesOwner, err = compileMatchExpression(matchRules.Expression); err != nil {
+			return nil, fmt.Errorf("invalid expression %q: %v", matchRules.Expression, err)
+		}
+		matcher.needsOwner = usesOwner
+	}
+	if matcher.ownerKindRegex != nil || matcher.ownerNameRegex != nil {
+		matcher.needsOwner = true
+	}
+
+	return matcher, nil
+}
+
+func newValueMatchers(rules *[]map[string]string) ([]valueMatcher, error) {
+	matchers := []valueMatcher{}
+	if rules == nil {
+		return matchers, nil
+	}
+	for _, rule := range *rules {
+		for key, regex := range rule {
+			compiled, err := regexp.Compile(regex)
+			if err != nil {
+				return nil, fmt.Errorf("%s regex %q: %v", key, regex, err)
+			}
+			matchers = append(matchers, valueMatcher{key: key, regex: compiled})
+		}
+	}
+	return matchers, nil
+}
+
+func (m *ruleMatcher) matches(target *matchTarget) bool {
+	return m.mismatch(target) == ""
+}
+
+// mismatch returns the first criterion the target does not match, or empty string if all match
+func (m *ruleMatcher) mismatch(target *matchTarget) string {
+	pod := target.pod
+	if m.namespaceRegex != nil && !m.namespaceRegex.MatchString(pod.GetNamespace()) {
+		return fmt.Sprintf("namespaceRegex '%s' does not match namespace %s", m.namespaceRegex, pod.GetNamespace())
+	}
+	if m.podNameRegex != nil && !m.podNameRegex.MatchString(pod.GetName()) {
+		return fmt.Sprintf("podNameRegex '%s' does not match pod name %s", m.podNameRegex, pod.GetName())
+	}
+	if m.imageRegex != nil && m.matchingContainer(pod) < 0 {
+		return fmt.Sprintf("imageRegex '%s' does not match image of any container", m.imageRegex)
+	}
+	// lookup rule annotation or label name in pod. If not found, no match. If found, check regex
+	if reason := valuesMismatch("annotation", m.annotations, pod.GetAnnotations()); reason != "" {
+		return reason
+	}
+	if reason := valuesMismatch("label", m.labels, pod.GetLabels()); reason != "" {
+		return reason
+	}
+	if m.labelSelector != nil && !m.labelSelector.Matches(labels.Set(pod.GetLabels())) {
+		return fmt.Sprintf("label selector '%s' does not match pod labels", m.labelSelector)
+	}
+	if m.namespaceSelector != nil || len(m.namespaceAnnotations) > 0 {
+		ns, err := target.getNamespace()
+		if err != nil {
+			log.Printf("Cannot get namespace %s to match: %v\n", pod.GetNamespace(), err)
+			return fmt.Sprintf("cannot get namespace %s: %v", pod.GetNamespace(), err)
+		}
+		if m.namespaceSelector != nil && !m.namespaceSelector.Matches(labels.Set(ns.GetLabels())) {
+			return fmt.Sprintf("namespaceSelector '%s' does not match namespace labels", m.namespaceSelector)
+		}
+		if reason := valuesMismatch("namespace annotation", m.namespaceAnnotations, ns.GetAnnotations()); reason != "" {
+			return reason
+		}
+	}
+	if m.ownerKindRegex != nil || m.ownerNameRegex != nil {
+		// pods without a controller never match owner criteria
+		owner := target.getOwner()
+		if owner == nil {
+			return "pod has no owner to match ownerKind and ownerNameRegex"
+		}
+		if m.ownerKindRegex != nil && !m.ownerKindRegex.MatchString(owner.Kind) {
+			return fmt.Sprintf("ownerKind '%s' does not match owner kind %s", m.ownerKindRegex, owner.Kind)
+		}
+		if m.ownerNameRegex != nil && !m.ownerNameRegex.MatchString(owner.Name) {
+			return fmt.Sprintf("ownerNameRegex '%s' does not match owner name %s", m.ownerNameRegex, owner.Name)
+		}
+	}
+	if m.expression != nil {
+		matched, err := evalMatchExpression(m.expression, target)
+		if err != nil {
+			return fmt.Sprintf("expression failed: %v", err)
+		}
+		if !matched {
+			return "expression evaluated to false"
+		}
+	}
+	// rollout goes last, so that the owner is looked up only for pods matching the other criteria
+	if m.rolloutPercentage != nil {
+		if bucket := rolloutBucket(target); bucket >= *m.rolloutPercentage {
+			return fmt.Sprintf("pod not in rollout of %d%% (bucket %d)", *m.rolloutPercentage, bucket)
+		}
+	}
+	return ""
+}
+
+// inactive returns why the rule is turned off at the time, or empty string if the rule applies
+func (r *InstrumentationRule) inactive(now time.Time) string {
+	if r.Suspend != nil && *r.Suspend {
+		return "suspended"
+	}
+	if r.ActiveFrom != nil && now.Before(r.ActiveFrom.Time) {
+		return fmt.Sprintf("not active until %s", r.ActiveFrom.Format(time.RFC3339))
+	}
+	if r.ActiveUntil != nil && !now.Before(r.ActiveUntil.Time) {
+		return fmt.Sprintf("not active since %s", r.ActiveUntil.Format(time.RFC3339))
+	}
+	return ""
+}
+
+// matchingContainer returns index of the first container with image matching imageRegex, or -1
+func (m *ruleMatcher) matchingContainer(pod corev1.Pod) int {
+	for idx, container := range pod.Spec.Containers {
+		if m.imageRegex.MatchString(container.Image) {
+			return idx
+		}
+	}
+	return -1
+}
+
+// selectContainer returns index of the container to instrument, the first one unless
+// the rule matched by container image
+func (m *ruleMatcher) selectContainer(pod corev1.Pod) int {
+	if m == nil || m.imageRegex == nil {
+		return 0
+	}
+	if idx := m.matchingContainer(pod); idx >= 0 {
+		return idx
+	}
+	return 0
+}
+
+// valuesMismatch returns which of the label or annotation matchers does not match, or empty string
+func valuesMismatch(kind string, matchers []valueMatcher, values map[string]string) string {
+	for _, matcher := range matchers {
+		value, found := values[matcher.key]
+		if !found {
+			return fmt.Sprintf("%s %s not found", kind, matcher.key)
+		}
+		if !matcher.regex.MatchString(value) {
+			return fmt.Sprintf("%s %s value %s does not match '%s'", kind, matcher.key, value, matcher.regex)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,154 @@
+/*
+Copyright (c) 2019 Cisco Systems, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const METRICS_NAMESPACE = "webhook_instrumentor"
+
+// results of pod admission
+const (
+	ADMISSION_RESULT_INSTRUMENTED = "instrumented"
+	ADMISSION_RESULT_SKIPPED      = "skipped"
+	ADMISSION_RESULT_FAILED       = "failed"
+	ADMISSION_RESULT_DENIED       = "denied"
+)
+
+// sources instrumentation rules are loaded from
+const (
+	RULE_SOURCE_CONFIGMAP      = "configmap"
+	RULE_SOURCE_CLUSTER_CRD    = "cluster"
+	RULE_SOURCE_NAMESPACED_CRD = "namespaced"
+	RULE_SOURCE_FLEX_MATCH     = "flexmatch"
+)
+
+var (
+	admissionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "admissions_total",
+		Help:      "Number of pod admissions by result (instrumented, skipped, failed, denied).",
+	}, []string{"result"})
+
+	ruleMatchesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "rule_matches_total",
+		Help:      "Number of pods matched by instrumentation rule name and rule source.",
+	}, []string{"rule", "source"})
+
+	ruleConflictsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "rule_conflicts_total",
+		Help:      "Number of pods matched by another rule with the same priority as the applied rule.",
+	}, []string{"rule", "conflicting_rule"})
+
+	injectionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "injections_total",
+		Help:      "Number of injection rules applied to pods by technology and provider.",
+	}, []string{"technology", "provider"})
+
+	patchOperationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "patch_operations_total",
+		Help:      "Number of JSON patch operations returned for pods by operation.",
+	}, []string{"op"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "request_duration_seconds",
+		Help:      "Latency of admission webhook requests by handler.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"handler", "code"})
+
+	rulesDesc = prometheus.NewDesc(prometheus.BuildFQName(METRICS_NAMESPACE, "", "rules"),
+		"Number of loaded instrumentation rules by namespace and rule source.", []string{"namespace", "source"}, nil)
+
+	suspendedDesc = prometheus.NewDesc(prometheus.BuildFQName(METRICS_NAMESPACE, "", "suspended"),
+		"1 when instrumentation is suspended by the kill switch in the config map, 0 otherwise.", nil, nil)
+
+	collectorsDesc = prometheus.NewDesc(prometheus.BuildFQName(METRICS_NAMESPACE, "", "collectors"),
+		"Number of known OpenTelemetry collectors by namespace, empty namespace for the config map defined ones.", []string{"namespace"}, nil)
+)
+
+func init() {
+	// registered with the controller-runtime registry, so the reconciler metrics are exposed alongside
+	ctrlmetrics.Registry.MustRegister(
+		admissionsTotal,
+		ruleMatchesTotal,
+		ruleConflictsTotal,
+		injectionsTotal,
+		patchOperationsTotal,
+		requestDuration,
+		configCollector{},
+	)
+}
+
+// configCollector reports the size of the loaded configuration at scrape time
+type configCollector struct{}
+
+func (configCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- rulesDesc
+	ch <- suspendedDesc
+	ch <- collectorsDesc
+}
+
+func (configCollector) Collect(ch chan<- prometheus.Metric) {
+	config.mutex.Lock()
+	if config.InstrumentationConfig != nil {
+		ch <- prometheus.MustNewConstMetric(rulesDesc, prometheus.GaugeValue, float64(len(*config.InstrumentationConfig)), "", RULE_SOURCE_CONFIGMAP)
+	}
+	ch <- prometheus.MustNewConstMetric(rulesDesc, prometheus.GaugeValue, float64(len(*config.InstrumentationClusterCrds)), "", RULE_SOURCE_CLUSTER_CRD)
+	for namespace, instrConfig := range config.InstrumentationNamespacedCrds {
+		ch <- prometheus.MustNewConstMetric(rulesDesc, prometheus.GaugeValue, float64(len(*instrConfig)), namespace, RULE_SOURCE_NAMESPACED_CRD)
+	}
+	suspended := 0.0
+	if config.InstrumentationSuspended {
+		suspended = 1.0
+	}
+	ch <- prometheus.MustNewConstMetric(suspendedDesc, prometheus.GaugeValue, suspended)
+	config.mutex.Unlock()
+
+	otelCollsConfigMutex.Lock()
+	ch <- prometheus.MustNewConstMetric(collectorsDesc, prometheus.GaugeValue, float64(len(otelCollsConfig)), "")
+	for namespace, collectors := range otelCollsConfigNamespaced {
+		ch <- prometheus.MustNewConstMetric(collectorsDesc, prometheus.GaugeValue, float64(len(collectors)), namespace)
+	}
+	otelCollsConfigMutex.Unlock()
+}
+
+// countPatchOperations records the patch operations returned for a pod
+func countPatchOperations(patchOps []patchOperation) {
+	for _, patchOp := range patchOps {
+		patchOperationsTotal.WithLabelValues(patchOp.Op).Inc()
+	}
+}
+
+// metricsHandler measures latency of the wrapped handler
+func metricsHandler(handler http.Handler, handlerName string) http.Handler {
+	return promhttp.InstrumentHandlerDuration(requestDuration.MustCurryWith(prometheus.Labels{"handler": handlerName}), handler)
+}
+
+// registerMetricsHandler adds the /metrics endpoint to the mux
+func registerMetricsHandler(mux *http.ServeMux) {
+	mux.Handle("/metrics", promhttp.HandlerFor(ctrlmetrics.Registry, promhttp.HandlerOpts{}))
+}
@@ -0,0 +1,80 @@
+/*
+Copyright (c) 2019 Cisco Systems, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/tools/cache"
+)
+
+// namespaceStore caches namespaces for matching rules on namespace labels and annotations,
+// see startNamespaceWatcher. It's set once the watcher starts while admissions may already be served
+var namespaceStore atomic.Pointer[cache.Store]
+
+// namespacesSynced is set once the namespace cache was listed
+var namespacesSynced atomic.Bool
+
+// startNamespaceWatcher creates the namespace cache and keeps it in sync in background
+func startNamespaceWatcher() {
+	watchlist := cache.NewListWatchFromClient(clientset.CoreV1().RESTClient(), "namespaces", "", fields.Everything())
+	store, controller := cache.NewInformer(
+		watchlist,
+		&corev1.Namespace{},
+		time.Second*0,
+		cache.ResourceEventHandlerFuncs{},
+	)
+	namespaceStore.Store(&store)
+	stop := make(chan struct{})
+	go controller.Run(stop)
+	go func() {
+		if cache.WaitForCacheSync(stop, controller.HasSynced) {
+			namespacesSynced.Store(true)
+		}
+	}()
+}
+
+// getNamespace returns the namespace from the cache. Namespace created just before its first pod may
+// not be in the cache yet, then it's read from the API server.
+func getNamespace(name string) (*corev1.Namespace, error) {
+	if store := namespaceStore.Load(); store != nil {
+		obj, found, err := (*store).GetByKey(name)
+		if err == nil && found {
+			if ns, isType := obj.(*corev1.Namespace); isType {
+				return ns, nil
+			}
+		}
+	}
+	log.Printf("Namespace %s not in cache, reading from API server\n", name)
+	return clientset.CoreV1().Namespaces().Get(context.Background(), name, metav1.GetOptions{})
+}
+
+// namespacesSyncedCheck is ready once the namespace cache was listed
+func namespacesSyncedCheck(_ *http.Request) error {
+	if !namespacesSynced.Load() {
+		return errors.New("namespace cache not synced")
+	}
+	return nil
+}
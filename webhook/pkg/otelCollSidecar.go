@@ -74,9 +74,7 @@ func loadOtelConfig(cm map[string]string) {
 	}
 }
 
-func addOtelCollSidecar(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerIdx int) []patchOperation {
-	patchOps := []patchOperation{}
-
+func addOtelCollSidecar(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerIdx int) {
 	if len(pod.Spec.Containers) > 0 {
 		// TODO - lookup the otel template for instrumentation rule
 		limCPU, _ := resource.ParseQuantity("1")
@@ -92,12 +90,12 @@ func addOtelCollSidecar(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec
 		otelCollConfig, namespaced, err := getCollectorConfigsByName(pod.GetNamespace(), instrRules.InjectionRules.OpenTelemetryCollector)
 		if err != nil {
 			log.Printf("Cannot find OTel collector definition %v\n", err)
-			return []patchOperation{}
+			return
 		}
 
 		if namespaced {
-			patchOps = append(patchOps, addOtelCollSidecarNamespaced(pod, instrRules, containerIdx)...)
-			return patchOps
+			addOtelCollSidecarNamespaced(pod, instrRules, containerIdx)
+			return
 		}
 
 		// else use the configmap based configuration, for the time being, less sophisticated
@@ -156,29 +154,18 @@ func addOtelCollSidecar(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec
 			},
 		}
 
-		patchOps = append(patchOps, patchOperation{
-			Op:    "add",
-			Path:  "/spec/containers/-",
-			Value: sidecar,
-		})
-
-		patchOps = append(patchOps, patchOperation{
-			Op:    "add",
-			Path:  "/spec/initContainers/-",
-			Value: sidecarInit,
-		})
-
-		patchOps = append(patchOps, patchOperation{
-			Op:    "add",
-			Path:  "/spec/volumes/-",
-			Value: configVolume,
-		})
-	}
+		addContainer(pod, sidecar)
+
+		addInitContainer(pod, sidecarInit)
 
-	return patchOps
+		addVolume(pod, configVolume)
+	}
 }
 
 func getCollectorConfigsByName(namespace string, otelCollName string) (*OtelCollConfig, bool, error) {
+	otelCollsConfigMutex.Lock()
+	defer otelCollsConfigMutex.Unlock()
+
 	// first check, if there's a match in namespaced collectors
 	otelCollsInNamespace, found := otelCollsConfigNamespaced[namespace]
 	if found {
@@ -197,13 +184,11 @@ func getCollectorConfigsByName(namespace string, otelCollName string) (*OtelColl
 	}
 }
 
-func addOtelCollSidecarNamespaced(pod corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerIdx int) []patchOperation {
-	patchOps := []patchOperation{}
-
+func addOtelCollSidecarNamespaced(pod *corev1.Pod, instrRules *v1alpha1.InstrumentationSpec, containerIdx int) {
 	otelCollConfig, namespaced, err := getCollectorConfigsByName(pod.GetNamespace(), instrRules.InjectionRules.OpenTelemetryCollector)
 	if err != nil || !namespaced {
 		log.Printf("Cannot find namespaced (%t) OTel collector definition %v\n", namespaced, err)
-		return []patchOperation{}
+		return
 	}
 
 	// here we rely on CRD-based otel col spec. In future, this should be changed for config map-based
@@ -212,8 +197,7 @@ func addOtelCollSidecarNamespaced(pod corev1.Pod, instrRules *v1alpha1.Instrumen
 
 	if otelCollSpec.Mode != v1alpha1.ModeSidecar {
 		log.Printf("Sidecar OTEL collector has invalid mode %s\n", otelCollSpec.Mode)
-		return []patchOperation{}
-
+		return
 	}
 
 	if otelCollSpec.Image == "" {
@@ -276,36 +260,21 @@ func addOtelCollSidecarNamespaced(pod corev1.Pod, instrRules *v1alpha1.Instrumen
 		},
 	}
 
-	patchOps = append(patchOps, patchOperation{
-		Op:    "add",
-		Path:  "/spec/containers/-",
-		Value: sidecar,
-	})
+	addContainer(pod, sidecar)
 
-	patchOps = append(patchOps, patchOperation{
-		Op:    "add",
-		Path:  "/spec/initContainers/-",
-		Value: sidecarInit,
-	})
+	addInitContainer(pod, sidecarInit)
 
-	patchOps = append(patchOps, patchOperation{
-		Op:    "add",
-		Path:  "/spec/volumes/-",
-		Value: configVolume,
-	})
+	addVolume(pod, configVolume)
 
 	for _, vol := range otelCollSpec.Volumes {
-		patchOps = append(patchOps, patchOperation{
-			Op:    "add",
-			Path:  "/spec/volumes/-",
-			Value: vol,
-		})
+		addVolume(pod, vol)
 	}
-
-	return patchOps
 }
 
 func registerNamespacedSidecarCollector(namespace string, collector *v1alpha1.OpenTelemetryCollector) {
+	otelCollsConfigMutex.Lock()
+	defer otelCollsConfigMutex.Unlock()
+
 	collectors := map[string]OtelCollConfig{}
 	found := false
 	if collectors, found = otelCollsConfigNamespaced[namespace]; !found {
@@ -329,6 +298,9 @@ func registerNamespacedSidecarCollector(namespace string, collector *v1alpha1.Op
 }
 
 func unregisterNamespacedCollector(namespace string, name string) {
+	otelCollsConfigMutex.Lock()
+	defer otelCollsConfigMutex.Unlock()
+
 	if collectors, found := otelCollsConfigNamespaced[namespace]; found {
 		delete(collectors, name)
 		otelCollsConfigNamespaced[namespace] = collectors
@@ -336,6 +308,9 @@ func unregisterNamespacedCollector(namespace string, name string) {
 }
 
 func registerNamespacedStandaloneCollector(namespace string, collector *v1alpha1.OpenTelemetryCollector) {
+	otelCollsConfigMutex.Lock()
+	defer otelCollsConfigMutex.Unlock()
+
 	collectors := map[string]OtelCollConfig{}
 	found := false
 	if collectors, found = otelCollsConfigNamespaced[namespace]; !found {
@@ -0,0 +1,65 @@
+/*
+Copyright (c) 2019 Cisco Systems, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// OWNER_LOOKUP_TIMEOUT bounds reading the owner chain of a pod. The lookup runs in the admission path,
+// so it must stay well within the webhook timeoutSeconds, which may be as low as 1 second
+const OWNER_LOOKUP_TIMEOUT = 500 * time.Millisecond
+
+// getWorkloadOwner resolves the top-level controller of the pod, following ReplicaSets to their Deployment
+// (or Rollout) and Jobs to their CronJob. Returns nil for pods without a controller.
+func getWorkloadOwner(pod corev1.Pod) *metav1.OwnerReference {
+	owner := metav1.GetControllerOf(&pod)
+	if owner == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), OWNER_LOOKUP_TIMEOUT)
+	defer cancel()
+
+	var parent *metav1.OwnerReference
+	switch owner.Kind {
+	case "ReplicaSet":
+		rs, err := clientset.AppsV1().ReplicaSets(pod.GetNamespace()).Get(ctx, owner.Name, metav1.GetOptions{})
+		if err != nil {
+			log.Log.Info("Cannot read owner of pod", "kind", owner.Kind, "name", owner.Name, "error", err.Error())
+		} else {
+			parent = metav1.GetControllerOf(rs)
+		}
+	case "Job":
+		job, err := clientset.BatchV1().Jobs(pod.GetNamespace()).Get(ctx, owner.Name, metav1.GetOptions{})
+		if err != nil {
+			log.Log.Info("Cannot read owner of pod", "kind", owner.Kind, "name", owner.Name, "error", err.Error())
+		} else {
+			parent = metav1.GetControllerOf(job)
+		}
+	}
+	if parent != nil {
+		owner = parent
+	}
+
+	return owner
+}
@@ -0,0 +1,228 @@
+/*
+Copyright (c) 2019 Cisco Systems, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"v1alpha1"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// name suffix of the ReplicaSet a previewed Deployment pod is owned by, tier name
+// derived from the owner strips it the same way as the pod-template-hash
+const PREVIEW_REPLICASET_HASH = "preview"
+
+// ordinal of the StatefulSet pod previewed, stateful set pods are named <name>-<ordinal>
+const PREVIEW_STATEFULSET_ORDINAL = "0"
+
+// PreviewRequest is the body of POST /api/preview. Object is a Pod, Deployment, StatefulSet or Job,
+// namespace defaults to the namespace of the object.
+type PreviewRequest struct {
+	Namespace string               `json:"namespace,omitempty"`
+	Object    runtime.RawExtension `json:"object"`
+}
+
+// PreviewResponse tells what the webhook would do with the pod, without persisting anything
+type PreviewResponse struct {
+	Rule       *v1alpha1.InstrumentationSpec `json:"rule,omitempty"`
+	RuleSource string                        `json:"ruleSource,omitempty"`
+	// Allowed is false when the failure policy of the rule would deny the pod
+	Allowed  bool             `json:"allowed"`
+	Failures []string         `json:"failures,omitempty"`
+	Patch    []patchOperation `json:"patch"`
+	Pod      *corev1.Pod      `json:"pod"`
+	// AlreadyInstrumented is the reason the pod is left as is, because it was instrumented before
+	AlreadyInstrumented string `json:"alreadyInstrumented,omitempty"`
+}
+
+func previewHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			log.Log.Info("Preview unsupported method called", "method", r.Method)
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+			return
+		}
+
+		previewRequest := PreviewRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&previewRequest); err != nil {
+			http.Error(w, fmt.Sprintf("could not parse preview request: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		pod, workloadOwner, err := previewPod(previewRequest)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if config.ControllerConfig == nil || config.InstrumentationConfig == nil {
+			http.Error(w, "instrumentor configuration not read from configmap", http.StatusServiceUnavailable)
+			return
+		}
+
+		previewResponse, err := previewInstrumentation(pod, workloadOwner)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(previewResponse); err != nil {
+			log.Log.Error(err, "cannot write preview response")
+		}
+	})
+}
+
+// previewPod builds the pod as it would be admitted from a pod or a workload pod template. For workloads,
+// it also returns the top-level owner, which does not exist in the cluster to be looked up.
+func previewPod(previewRequest PreviewRequest) (corev1.Pod, *metav1.OwnerReference, error) {
+	pod := corev1.Pod{}
+
+	typeMeta := metav1.TypeMeta{}
+	if err := json.Unmarshal(previewRequest.Object.Raw, &typeMeta); err != nil {
+		return pod, nil, fmt.Errorf("could not parse object: %v", err)
+	}
+
+	var objectMeta metav1.ObjectMeta
+	var template corev1.PodTemplateSpec
+	var owner metav1.OwnerReference
+	var workloadOwner *metav1.OwnerReference
+
+	switch typeMeta.GroupVersionKind() {
+	case corev1.SchemeGroupVersion.WithKind("Pod"):
+		if err := json.Unmarshal(previewRequest.Object.Raw, &pod); err != nil {
+			return pod, nil, fmt.Errorf("could not parse Pod: %v", err)
+		}
+		if len(pod.Name) == 0 && len(pod.GenerateName) > 0 {
+			pod.Name = pod.GenerateName
+		}
+	case appsv1.SchemeGroupVersion.WithKind("Deployment"):
+		deployment := appsv1.Deployment{}
+		if err := json.Unmarshal(previewRequest.Object.Raw, &deployment); err != nil {
+			return pod, nil, fmt.Errorf("could not parse Deployment: %v", err)
+		}
+		objectMeta, template = deployment.ObjectMeta, deployment.Spec.Template
+		owner = metav1.OwnerReference{APIVersion: appsv1.SchemeGroupVersion.String(), Kind: "ReplicaSet",
+			Name: deployment.Name + "-" + PREVIEW_REPLICASET_HASH}
+		workloadOwner = &metav1.OwnerReference{APIVersion: appsv1.SchemeGroupVersion.String(), Kind: "Deployment", Name: deployment.Name}
+	case appsv1.SchemeGroupVersion.WithKind("StatefulSet"):
+		statefulSet := appsv1.StatefulSet{}
+		if err := json.Unmarshal(previewRequest.Object.Raw, &statefulSet); err != nil {
+			return pod, nil, fmt.Errorf("could not parse StatefulSet: %v", err)
+		}
+		objectMeta, template = statefulSet.ObjectMeta, statefulSet.Spec.Template
+		owner = metav1.OwnerReference{APIVersion: appsv1.SchemeGroupVersion.String(), Kind: "StatefulSet", Name: statefulSet.Name}
+	case batchv1.SchemeGroupVersion.WithKind("Job"):
+		job := batchv1.Job{}
+		if err := json.Unmarshal(previewRequest.Object.Raw, &job); err != nil {
+			return pod, nil, fmt.Errorf("could not parse Job: %v", err)
+		}
+		objectMeta, template = job.ObjectMeta, job.Spec.Template
+		owner = metav1.OwnerReference{APIVersion: batchv1.SchemeGroupVersion.String(), Kind: "Job", Name: job.Name}
+		workloadOwner = metav1.GetControllerOf(&job)
+	default:
+		return pod, nil, fmt.Errorf("unsupported object %s, expected Pod, Deployment, StatefulSet or Job", typeMeta.GroupVersionKind())
+	}
+
+	if owner.Kind != "" {
+		// pods of workloads are created with generated names, owned by the workload controller,
+		// except for stateful set pods, which are named by their ordinal. the first one is previewed
+		pod.ObjectMeta = template.ObjectMeta
+		pod.Spec = template.Spec
+		if owner.Kind == "StatefulSet" {
+			pod.Name = owner.Name + "-" + PREVIEW_STATEFULSET_ORDINAL
+		} else {
+			pod.Name = owner.Name + "-"
+			pod.GenerateName = pod.Name
+		}
+		pod.Namespace = objectMeta.Namespace
+		controller := true
+		owner.Controller = &controller
+		pod.OwnerReferences = []metav1.OwnerReference{owner}
+		if workloadOwner == nil {
+			workloadOwner = &owner
+		}
+	}
+	pod.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"}
+
+	if previewRequest.Namespace != "" {
+		pod.Namespace = previewRequest.Namespace
+	}
+	if pod.Namespace == "" {
+		return pod, nil, fmt.Errorf("namespace must be specified")
+	}
+
+	return pod, workloadOwner, nil
+}
+
+// previewInstrumentation runs the matching and injection the same way as the admission does, but
+// without recording events or metrics
+func previewInstrumentation(pod corev1.Pod, workloadOwner *metav1.OwnerReference) (*PreviewResponse, error) {
+	previewResponse := &PreviewResponse{
+		Allowed: true,
+		Patch:   []patchOperation{},
+		Pod:     &pod,
+	}
+
+	if previewResponse.AlreadyInstrumented = alreadyInstrumented(pod); previewResponse.AlreadyInstrumented != "" {
+		return previewResponse, nil
+	}
+
+	target := newMatchTarget(pod)
+	if workloadOwner != nil {
+		target.owner, target.ownerResolved = workloadOwner, true
+	}
+	instrumentationRule, ruleSource := matchInstrumentationRule(target)
+	if instrumentationRule == nil {
+		return previewResponse, nil
+	}
+	previewResponse.Rule = instrumentationRule.InstrumentationSpec.DeepCopy()
+	previewResponse.RuleSource = ruleSource
+
+	mutatedPod := pod.DeepCopy()
+	config.mutex.Lock()
+	outcomes := instrumentPod(mutatedPod, instrumentationRule)
+	config.mutex.Unlock()
+
+	for _, outcome := range outcomes {
+		if outcome.Failure != "" {
+			previewResponse.Failures = append(previewResponse.Failures, outcome.Failure)
+		}
+	}
+	if injectionFailed(outcomes) && instrumentationRule.FailurePolicy == v1alpha1.FailurePolicyFail {
+		previewResponse.Allowed = false
+		return previewResponse, nil
+	}
+
+	patches, err := createPatch(&pod, mutatedPod)
+	if err != nil {
+		return nil, err
+	}
+	previewResponse.Patch = patches
+	previewResponse.Pod = mutatedPod
+
+	return previewResponse, nil
+}
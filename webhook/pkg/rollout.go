@@ -0,0 +1,44 @@
+/*
+Copyright (c) 2019 Cisco Systems, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"hash/fnv"
+)
+
+// rolloutKey identifies the pod for rollout across restarts. Pods of workloads get generated names, which are
+// not known at admission time and change with every restart, so those are identified by the workload only
+// and the whole workload is in or out. Pods with fixed names, like those of StatefulSets, are selected one by one.
+func rolloutKey(target *matchTarget) string {
+	pod := target.pod
+	key := pod.GetNamespace()
+	if owner := target.getOwner(); owner != nil {
+		key += "/" + owner.Kind + "/" + owner.Name
+		if pod.GetGenerateName() != "" && pod.GetName() == pod.GetGenerateName() {
+			return key
+		}
+	}
+	return key + "/" + pod.GetName()
+}
+
+// rolloutBucket places the pod into one of 100 buckets by hash of its rollout key. Pods in buckets below
+// the percentage are in the rollout, so raising the percentage keeps the pods selected before.
+func rolloutBucket(target *matchTarget) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(rolloutKey(target)))
+	return int(hash.Sum32() % 100)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"sigs.k8s.io/e2e-framework/pkg/envconf"
+	"sigs.k8s.io/e2e-framework/pkg/features"
+)
+
+// assertContainerSelection instruments the pod with istio-proxy sidecar listed first by the instrumentation
+// and checks which of the containers got the agent
+func assertContainerSelection(t *testing.T, feature string, instrFilename string, expected []string) {
+	f := features.New(feature).
+		Assess("select containers", func(ctx context.Context, t *testing.T, cfg *envconf.Config) context.Context {
+			err := testenv.deployInstrumentation(ctx, t, cfg, instrFilename, 0)
+			if err != nil {
+				t.Error(err, "cannot deploy instrumentation per file: "+instrFilename)
+				t.FailNow()
+			}
+
+			pod := testenv.deployPod(ctx, t, cfg, "../e2e-tests/containers/pod.yaml")
+
+			testenv.requireEqual(t, "instrumented containers", testenv.containersWithEnv(pod, "JAVA_TOOL_OPTIONS"), expected)
+			testenv.requireEqual(t, "init containers", testenv.containerNames(pod.Spec.InitContainers),
+				[]string{"appd-agent-attach-java"})
+
+			return ctx
+		})
+
+	testenv.env.Test(t, f.Feature())
+}
+
+func TestContainerSelectorName(t *testing.T) {
+	assertContainerSelection(t, "Container selected by name",
+		"../e2e-tests/containers/name/instrumentation.yaml", []string{"worker-b"})
+}
+
+func TestContainerSelectorNameRegex(t *testing.T) {
+	assertContainerSelection(t, "Containers selected by name regex, sidecar excluded",
+		"../e2e-tests/containers/nameRegex/instrumentation.yaml", []string{"worker-a", "worker-b"})
+}
+
+func TestContainerSelectorImageRegex(t *testing.T) {
+	assertContainerSelection(t, "Containers selected by image regex",
+		"../e2e-tests/containers/imageRegex/instrumentation.yaml", []string{"web"})
+}
+
+func TestContainerSelectorAllApplicationContainers(t *testing.T) {
+	assertContainerSelection(t, "All application containers selected, sidecar excluded",
+		"../e2e-tests/containers/all/instrumentation.yaml", []string{"web", "worker-a", "worker-b"})
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/e2e-framework/pkg/envconf"
+	"sigs.k8s.io/e2e-framework/pkg/features"
+)
+
+func TestInstrumentMissingCollector(t *testing.T) {
+	f := features.New("Pod is created uninstrumented when OpenTelemetry collector is missing").
+		Assess("rule with missing collector", func(ctx context.Context, t *testing.T, cfg *envconf.Config) context.Context {
+			pod := testenv.deployPod(ctx, t, cfg, "../e2e-tests/failure/cm/pod.yaml")
+
+			if status := pod.Annotations["APPD_INSTRUMENTATION_STATUS"]; status != "FAILED" {
+				t.Errorf("instrumentation status is '%s', expected FAILED", status)
+				t.FailNow()
+			}
+			if reason := pod.Annotations["APPD_INSTRUMENTATION_FAILURE_REASON"]; !strings.Contains(reason, "missing-collector") {
+				t.Errorf("failure reason '%s' does not name the missing collector", reason)
+				t.FailNow()
+			}
+			if rule, found := pod.Annotations["OTEL_INSTRUMENTATION_VIA_RULE"]; found {
+				t.Errorf("pod marked as instrumented by rule %s", rule)
+				t.FailNow()
+			}
+
+			// nothing of the failed injection gets into the pod
+			testenv.requireEqual(t, "init containers", testenv.containerNames(pod.Spec.InitContainers), []string{})
+			testenv.requireEqual(t, "containers", testenv.containerNames(pod.Spec.Containers), []string{"app"})
+			testenv.requireEqual(t, "env of container app", testenv.envNames(pod.Spec.Containers[0]), []string{})
+
+			return ctx
+		})
+
+	testenv.env.Test(t, f.Feature())
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"sigs.k8s.io/e2e-framework/pkg/envconf"
+	"sigs.k8s.io/e2e-framework/pkg/features"
+)
+
+func TestPatchJavaReadmission(t *testing.T) {
+	f := features.New("Java AppD Instrumentation is not applied again to instrumented pod").
+		Assess("readmit instrumented pod", func(ctx context.Context, t *testing.T, cfg *envconf.Config) context.Context {
+			instrFilename := "../e2e-tests/java/instr/instrumentation.yaml"
+			err := testenv.deployInstrumentation(ctx, t, cfg, instrFilename, 0)
+			if err != nil {
+				t.Error(err, "cannot deploy instrumentation per file: "+instrFilename)
+				t.FailNow()
+			}
+
+			pod := testenv.deployPod(ctx, t, cfg, "../e2e-tests/java/instr/pod.yaml")
+			testenv.requirePod(t, pod, "../e2e-tests/java/instr/pod-assert.yaml")
+
+			// the copy carries the instrumentation already, admission must leave it as is
+			readmitted := testenv.readmitPod(ctx, t, cfg, pod, pod.Name+"-readmitted")
+
+			testenv.requireEqual(t, "rule annotations",
+				[]string{readmitted.Annotations["APPD_INSTRUMENTATION_VIA_RULE"]},
+				[]string{pod.Annotations["APPD_INSTRUMENTATION_VIA_RULE"]})
+			testenv.requireEqual(t, "init containers",
+				testenv.containerNames(readmitted.Spec.InitContainers), testenv.containerNames(pod.Spec.InitContainers))
+			testenv.requireEqual(t, "containers",
+				testenv.containerNames(readmitted.Spec.Containers), testenv.containerNames(pod.Spec.Containers))
+			for i := range pod.Spec.Containers {
+				testenv.requireEqual(t, "env of container "+pod.Spec.Containers[i].Name,
+					testenv.envNames(readmitted.Spec.Containers[i]), testenv.envNames(pod.Spec.Containers[i]))
+			}
+			testenv.requireEqual(t, "volumes",
+				testenv.volumeNames(readmitted.Spec.Volumes), testenv.volumeNames(pod.Spec.Volumes))
+
+			return ctx
+		})
+
+	testenv.env.Test(t, f.Feature())
+}
+
+func TestPatchInjectionRuleSet(t *testing.T) {
+	f := features.New("AppD Instrumentation by injection rule set via ConfigMap").
+		Assess("instrument by all rules of the set", func(ctx context.Context, t *testing.T, cfg *envconf.Config) context.Context {
+			pod := testenv.deployPod(ctx, t, cfg, "../e2e-tests/ruleset/cm/pod.yaml")
+			testenv.requirePod(t, pod, "../e2e-tests/ruleset/cm/pod-assert.yaml")
+
+			testenv.requireEqual(t, "init containers", testenv.containerNames(pod.Spec.InitContainers),
+				[]string{"appd-agent-attach-java", "appd-agent-attach-dotnetcore", "appd-agent-attach-nodejs"})
+
+			return ctx
+		})
+
+	testenv.env.Test(t, f.Feature())
+}
+
+func TestPatchApacheOtel(t *testing.T) {
+	f := features.New("Apache OpenTelemetry Instrumentation via ConfigMap").
+		Assess("instrument apache", func(ctx context.Context, t *testing.T, cfg *envconf.Config) context.Context {
+			pod := testenv.deployPod(ctx, t, cfg, "../e2e-tests/apache/cm/pod.yaml")
+			testenv.requirePod(t, pod, "../e2e-tests/apache/cm/pod-assert.yaml")
+
+			testenv.requireEqual(t, "init containers", testenv.containerNames(pod.Spec.InitContainers),
+				[]string{"apache-source-copy", "otel-agent-attach-apache"})
+
+			return ctx
+		})
+
+	testenv.env.Test(t, f.Feature())
+}
+
+func TestPatchNginxOtel(t *testing.T) {
+	f := features.New("Nginx OpenTelemetry Instrumentation with sidecar collector via ConfigMap").
+		Assess("instrument nginx", func(ctx context.Context, t *testing.T, cfg *envconf.Config) context.Context {
+			pod := testenv.deployPod(ctx, t, cfg, "../e2e-tests/nginx/cm/pod.yaml")
+			testenv.requirePod(t, pod, "../e2e-tests/nginx/cm/pod-assert.yaml")
+
+			testenv.requireEqual(t, "init containers", testenv.containerNames(pod.Spec.InitContainers),
+				[]string{"nginx-source-copy", "otel-agent-attach-nginx", "otel-coll-sidecar-init"})
+			testenv.requireEqual(t, "containers", testenv.containerNames(pod.Spec.Containers),
+				[]string{"nginx", "otel-coll-sidecar"})
+
+			return ctx
+		})
+
+	testenv.env.Test(t, f.Feature())
+}
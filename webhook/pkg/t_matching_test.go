@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/e2e-framework/pkg/envconf"
+	"sigs.k8s.io/e2e-framework/pkg/features"
+)
+
+// requireInstrumentedBy fails the test, unless the pod was instrumented by the rule. Rules from namespaced
+// CRDs are named <namespace>/<name>, empty rule name means the pod must not be instrumented.
+func requireInstrumentedBy(t *testing.T, pod *v1.Pod, rule string) {
+	instrumentedBy, instrumented := pod.Annotations["APPD_INSTRUMENTATION_VIA_RULE"]
+	if rule == "" && instrumented {
+		t.Errorf("pod %s instrumented by rule %s, expected not to be instrumented", pod.Name, instrumentedBy)
+	} else if rule != "" && !strings.HasSuffix(instrumentedBy, "/"+rule) {
+		t.Errorf("pod %s instrumented by rule '%s', expected rule %s", pod.Name, instrumentedBy, rule)
+	} else {
+		return
+	}
+	if testenv.getEnv("TEST_WAIT_ON_FAIL", "") != "" {
+		testenv.wait()
+	}
+	t.FailNow()
+}
+
+func deployInstrumentations(ctx context.Context, t *testing.T, cfg *envconf.Config, instrFilenames ...string) {
+	for _, instrFilename := range instrFilenames {
+		err := testenv.deployInstrumentation(ctx, t, cfg, instrFilename, 0)
+		if err != nil {
+			t.Error(err, "cannot deploy instrumentation per file: "+instrFilename)
+			t.FailNow()
+		}
+	}
+}
+
+func TestMatchImageRegex(t *testing.T) {
+	f := features.New("Rule matched by container image instruments the matching container").
+		Assess("match by image", func(ctx context.Context, t *testing.T, cfg *envconf.Config) context.Context {
+			deployInstrumentations(ctx, t, cfg, "../e2e-tests/matching/imageRegex/instrumentation.yaml")
+
+			pod := testenv.deployPod(ctx, t, cfg, "../e2e-tests/matching/pod.yaml")
+
+			requireInstrumentedBy(t, pod, "matching-image-regex")
+			// istio-proxy is listed first, but the agent goes to the container matched by image
+			testenv.requireEqual(t, "instrumented containers", testenv.containersWithEnv(pod, "JAVA_TOOL_OPTIONS"), []string{"app"})
+
+			return ctx
+		})
+
+	testenv.env.Test(t, f.Feature())
+}
+
+func TestMatchExpression(t *testing.T) {
+	f := features.New("Rule matched by CEL expression").
+		Assess("match by expression", func(ctx context.Context, t *testing.T, cfg *envconf.Config) context.Context {
+			deployInstrumentations(ctx, t, cfg, "../e2e-tests/matching/expression/instrumentation.yaml")
+
+			pod := testenv.deployPod(ctx, t, cfg, "../e2e-tests/matching/expression/pod.yaml")
+			requireInstrumentedBy(t, pod, "matching-expression")
+
+			pod = testenv.deployPod(ctx, t, cfg, "../e2e-tests/matching/expression/pod-not-matching.yaml")
+			requireInstrumentedBy(t, pod, "")
+
+			return ctx
+		})
+
+	testenv.env.Test(t, f.Feature())
+}
+
+func TestMatchRolloutNone(t *testing.T) {
+	f := features.New("Pod outside of rollout is matched against further rules").
+		Assess("rollout of 0 percent", func(ctx context.Context, t *testing.T, cfg *envconf.Config) context.Context {
+			deployInstrumentations(ctx, t, cfg,
+				"../e2e-tests/matching/rolloutNone/instrumentation.yaml",
+				"../e2e-tests/matching/fallback/instrumentation.yaml")
+
+			pod := testenv.deployPod(ctx, t, cfg, "../e2e-tests/matching/pod.yaml")
+
+			requireInstrumentedBy(t, pod, "matching-fallback")
+
+			return ctx
+		})
+
+	testenv.env.Test(t, f.Feature())
+}
+
+func TestMatchRolloutAll(t *testing.T) {
+	f := features.New("Pod in rollout is instrumented by the rule").
+		Assess("rollout of 100 percent", func(ctx context.Context, t *testing.T, cfg *envconf.Config) context.Context {
+			deployInstrumentations(ctx, t, cfg,
+				"../e2e-tests/matching/rolloutAll/instrumentation.yaml",
+				"../e2e-tests/matching/fallback/instrumentation.yaml")
+
+			pod := testenv.deployPod(ctx, t, cfg, "../e2e-tests/matching/pod.yaml")
+
+			requireInstrumentedBy(t, pod, "matching-rollout-all")
+
+			return ctx
+		})
+
+	testenv.env.Test(t, f.Feature())
+}
+
+func TestMatchSuspended(t *testing.T) {
+	f := features.New("Suspended rule is skipped").
+		Assess("suspend rule", func(ctx context.Context, t *testing.T, cfg *envconf.Config) context.Context {
+			deployInstrumentations(ctx, t, cfg,
+				"../e2e-tests/matching/suspended/instrumentation.yaml",
+				"../e2e-tests/matching/fallback/instrumentation.yaml")
+
+			pod := testenv.deployPod(ctx, t, cfg, "../e2e-tests/matching/pod.yaml")
+
+			requireInstrumentedBy(t, pod, "matching-fallback")
+
+			return ctx
+		})
+
+	testenv.env.Test(t, f.Feature())
+}
+
+func TestMatchActiveWindowExpired(t *testing.T) {
+	f := features.New("Rule past its active time window is skipped").
+		Assess("expired rule", func(ctx context.Context, t *testing.T, cfg *envconf.Config) context.Context {
+			deployInstrumentations(ctx, t, cfg,
+				"../e2e-tests/matching/expired/instrumentation.yaml",
+				"../e2e-tests/matching/fallback/instrumentation.yaml")
+
+			pod := testenv.deployPod(ctx, t, cfg, "../e2e-tests/matching/pod.yaml")
+
+			requireInstrumentedBy(t, pod, "matching-fallback")
+
+			return ctx
+		})
+
+	testenv.env.Test(t, f.Feature())
+}
+
+func TestMatchActiveWindow(t *testing.T) {
+	f := features.New("Rule within its active time window applies").
+		Assess("active rule", func(ctx context.Context, t *testing.T, cfg *envconf.Config) context.Context {
+			deployInstrumentations(ctx, t, cfg,
+				"../e2e-tests/matching/window/instrumentation.yaml",
+				"../e2e-tests/matching/fallback/instrumentation.yaml")
+
+			pod := testenv.deployPod(ctx, t, cfg, "../e2e-tests/matching/pod.yaml")
+
+			requireInstrumentedBy(t, pod, "matching-window")
+
+			return ctx
+		})
+
+	testenv.env.Test(t, f.Feature())
+}
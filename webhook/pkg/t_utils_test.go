@@ -14,6 +14,7 @@ import (
 	"os/exec"
 	"reflect"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"testing"
@@ -22,6 +23,7 @@ import (
 
 	"github.com/pkg/errors"
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	sch "k8s.io/client-go/kubernetes/scheme"
@@ -392,6 +394,30 @@ func (t *TestFrame) deployInstrumentation(ctx context.Context, test *testing.T,
 	return nil
 }
 
+// createInstrumentation creates the instrumentation and returns the API server error instead of failing the test,
+// so denials by the validating webhook can be asserted
+func (t *TestFrame) createInstrumentation(ctx context.Context, test *testing.T, cfg *envconf.Config, filename string) error {
+	client, err := cfg.NewClient()
+	if err != nil {
+		test.Error(err, "cannot get k8s client")
+		test.FailNow()
+	}
+
+	ns := ctx.Value(testenv.getNamespaceKey(test)).(string)
+
+	resourceFile := t.fullFilename(filename)
+	objs, err := testenv.loadObjectsFile(resourceFile)
+	if err != nil {
+		test.Error(err, "cannot read instrumentation resource definition file", resourceFile)
+		test.FailNow()
+	}
+
+	obj := objs[0].(*v1alpha1.Instrumentation)
+	obj.SetNamespace(ns)
+
+	return client.Resources(ns).Create(ctx, obj)
+}
+
 func (t *TestFrame) deployOtelCol(ctx context.Context, test *testing.T, cfg *envconf.Config, filename string, delay int) error {
 	client, err := cfg.NewClient()
 	if err != nil {
@@ -421,23 +447,44 @@ func (t *TestFrame) deployOtelCol(ctx context.Context, test *testing.T, cfg *env
 	return nil
 }
 
-func (t *TestFrame) deployAndAssertPod(ctx context.Context, test *testing.T, cfg *envconf.Config, filenamePodToDeploy, filenamePodToAssert string) (bool, error, []string) {
-	client, err := cfg.NewClient()
+// deployPod creates the pod, waits until it's ready and returns the pod as admitted
+func (t *TestFrame) deployPod(ctx context.Context, test *testing.T, cfg *envconf.Config, filename string) *v1.Pod {
+	resourceFile := t.fullFilename(filename)
+	objs, err := testenv.loadObjectsFile(resourceFile)
 	if err != nil {
-		test.Error(err, "cannot get k8s client")
+		test.Error(err, "cannot read pod resource definition file", resourceFile)
 		test.FailNow()
 	}
 
-	ns := ctx.Value(testenv.getNamespaceKey(test)).(string)
+	return t.createPod(ctx, test, cfg, objs[0].(*v1.Pod))
+}
 
-	resourceFile := t.fullFilename(filenamePodToDeploy)
-	objs, err := testenv.loadObjectsFile(resourceFile)
+// readmitPod creates a copy of the admitted pod under a new name, so that the admission runs again
+// on a pod, which was mutated already, and returns the copy as admitted
+func (t *TestFrame) readmitPod(ctx context.Context, test *testing.T, cfg *envconf.Config, pod *v1.Pod, name string) *v1.Pod {
+	obj := &v1.Pod{
+		TypeMeta: pod.TypeMeta,
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Labels:      pod.Labels,
+			Annotations: pod.Annotations,
+		},
+		Spec: *pod.Spec.DeepCopy(),
+	}
+	obj.Spec.NodeName = ""
+
+	return t.createPod(ctx, test, cfg, obj)
+}
+
+func (t *TestFrame) createPod(ctx context.Context, test *testing.T, cfg *envconf.Config, obj *v1.Pod) *v1.Pod {
+	client, err := cfg.NewClient()
 	if err != nil {
-		test.Error(err, "cannot read pod resource definition file", resourceFile)
+		test.Error(err, "cannot get k8s client")
 		test.FailNow()
 	}
 
-	obj := objs[0].(*v1.Pod)
+	ns := ctx.Value(testenv.getNamespaceKey(test)).(string)
+
 	obj.SetNamespace(ns)
 	kind := obj.Kind
 	apiVersion := obj.APIVersion
@@ -462,6 +509,19 @@ func (t *TestFrame) deployAndAssertPod(ctx context.Context, test *testing.T, cfg
 	eobj.Kind = kind
 	eobj.APIVersion = apiVersion
 
+	return eobj
+}
+
+func (t *TestFrame) deployAndAssertPod(ctx context.Context, test *testing.T, cfg *envconf.Config, filenamePodToDeploy, filenamePodToAssert string) (bool, error, []string) {
+	eobj := t.deployPod(ctx, test, cfg, filenamePodToDeploy)
+
+	eq, diffs := t.assertPod(test, eobj, filenamePodToAssert)
+
+	return eq, nil, diffs
+}
+
+// assertPod compares the pod with the pod from the assertion file
+func (t *TestFrame) assertPod(test *testing.T, pod *v1.Pod, filenamePodToAssert string) (bool, []string) {
 	assertFile := t.fullFilename(filenamePodToAssert)
 	assertObj, err := testenv.loadObjectsFile(assertFile)
 	if err != nil {
@@ -469,10 +529,71 @@ func (t *TestFrame) deployAndAssertPod(ctx context.Context, test *testing.T, cfg
 		test.FailNow()
 	}
 
-	eq, diffs := testenv.compareObjects(eobj, assertObj[0])
+	eq, diffs := testenv.compareObjects(pod, assertObj[0])
 	test.Logf("objects are equal: %t, %s", eq, diffs)
 
-	return eq, nil, diffs
+	return eq, diffs
+}
+
+// requirePod fails the test, unless the pod matches the pod from the assertion file
+func (t *TestFrame) requirePod(test *testing.T, pod *v1.Pod, filenamePodToAssert string) {
+	if eq, diffs := t.assertPod(test, pod, filenamePodToAssert); !eq {
+		test.Error("assert failed for: " + pod.Name)
+		test.Error(t.formatDiffs(diffs))
+		if t.getEnv("TEST_WAIT_ON_FAIL", "") != "" {
+			t.wait()
+		}
+		test.FailNow()
+	}
+}
+
+// requireEqual fails the test, unless the lists are equal
+func (t *TestFrame) requireEqual(test *testing.T, what string, real []string, expected []string) {
+	if !slices.Equal(real, expected) {
+		test.Errorf("%s don't match - real %v != expected %v", what, real, expected)
+		if t.getEnv("TEST_WAIT_ON_FAIL", "") != "" {
+			t.wait()
+		}
+		test.FailNow()
+	}
+}
+
+// containerNames lists names of the containers in the order as in the pod
+func (t *TestFrame) containerNames(containers []v1.Container) []string {
+	names := []string{}
+	for _, container := range containers {
+		names = append(names, container.Name)
+	}
+	return names
+}
+
+// volumeNames lists names of the volumes in the order as in the pod
+func (t *TestFrame) volumeNames(volumes []v1.Volume) []string {
+	names := []string{}
+	for _, volume := range volumes {
+		names = append(names, volume.Name)
+	}
+	return names
+}
+
+// envNames lists names of the environment variables of the container
+func (t *TestFrame) envNames(container v1.Container) []string {
+	names := []string{}
+	for _, env := range container.Env {
+		names = append(names, env.Name)
+	}
+	return names
+}
+
+// containersWithEnv lists names of the containers of the pod, which have the environment variable set
+func (t *TestFrame) containersWithEnv(pod *v1.Pod, envName string) []string {
+	names := []string{}
+	for _, container := range pod.Spec.Containers {
+		if slices.Contains(t.envNames(container), envName) {
+			names = append(names, container.Name)
+		}
+	}
+	return names
 }
 
 func (t *TestFrame) formatDiffs(diffs []string) string {
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/e2e-framework/pkg/envconf"
+	"sigs.k8s.io/e2e-framework/pkg/features"
+)
+
+func TestValidateInstrumentationDenied(t *testing.T) {
+	f := features.New("Invalid Instrumentation is denied by validating webhook").
+		Assess("create invalid instrumentation", func(ctx context.Context, t *testing.T, cfg *envconf.Config) context.Context {
+			instrFilename := "../e2e-tests/validation/instrumentation-invalid.yaml"
+			err := testenv.createInstrumentation(ctx, t, cfg, instrFilename)
+			if err == nil {
+				t.Error("invalid instrumentation was admitted: " + instrFilename)
+				t.FailNow()
+			}
+
+			for _, expected := range []string{"spec.matchRules.podNameRegex", "spec.injectionRules.image"} {
+				if !strings.Contains(err.Error(), expected) {
+					t.Errorf("denial does not mention %s: %v", expected, err)
+				}
+			}
+
+			return ctx
+		})
+
+	testenv.env.Test(t, f.Feature())
+}
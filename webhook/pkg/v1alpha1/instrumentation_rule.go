@@ -36,6 +36,42 @@ type MatchRule struct {
 	// Regex to match names of pods
 	// +optional
 	PodNameRegex string `json:"podNameRegex,omitempty" yaml:"podNameRegex,omitempty"`
+
+	// Labels the pod must have with exactly these values, same as matchLabels of Kubernetes label selector
+	// +optional
+	MatchLabels map[string]string `json:"matchLabels,omitempty" yaml:"matchLabels,omitempty"`
+
+	// Requirements on pod labels, same as matchExpressions of Kubernetes label selector
+	// +optional
+	MatchExpressions []metav1.LabelSelectorRequirement `json:"matchExpressions,omitempty" yaml:"matchExpressions,omitempty"`
+
+	// Label selector of the namespace of the workload
+	// +optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty" yaml:"namespaceSelector,omitempty"`
+
+	// List of namespace annotations and their regex values to match
+	// +optional
+	NamespaceAnnotations *[]map[string]string `json:"namespaceAnnotations,omitempty" yaml:"namespaceAnnotations,omitempty"`
+
+	// Regex to match container images. Matches if image of any container matches,
+	// the first matching container is the one instrumented.
+	// +optional
+	ImageRegex string `json:"imageRegex,omitempty" yaml:"imageRegex,omitempty"`
+
+	// Kind of the top-level workload owning the pod, e.g. Deployment, StatefulSet, DaemonSet, CronJob or Rollout.
+	// ReplicaSets and Jobs are followed to their owners. Regex matched against the whole kind.
+	// +optional
+	OwnerKind string `json:"ownerKind,omitempty" yaml:"ownerKind,omitempty"`
+
+	// Regex to match name of the top-level workload owning the pod
+	// +optional
+	OwnerNameRegex string `json:"ownerNameRegex,omitempty" yaml:"ownerNameRegex,omitempty"`
+
+	// CEL expression over pod, namespace and owner objects, must evaluate to bool.
+	// Objects have the same structure as in the Kubernetes API, owner is the top-level
+	// workload owner reference, empty if the pod has no owner.
+	// +optional
+	Expression string `json:"expression,omitempty" yaml:"expression,omitempty"`
 }
 
 type InjectionRule struct {
@@ -73,6 +109,26 @@ type InjectionRule struct {
 	Options                    []NameValue          `json:"options,omitempty" yaml:"options,omitempty"`
 	InjectK8SOtelResourceAttrs *bool                `json:"injectK8SOtelResourceAttrs,omitempty" yaml:"injectK8SOtelResourceAttrs,omitempty"`
 	SplunkConfig               *SplunkConfig        `json:"splunkConfig,omitempty" yaml:"splunkConfig,omitempty"`
+	// Containers to instrument, by default the first container, or the container matched by imageRegex of match rules
+	// +optional
+	ContainerSelector *ContainerSelector `json:"containerSelector,omitempty" yaml:"containerSelector,omitempty"`
+}
+
+// ContainerSelector selects containers matching all the criteria specified. Apart from name, sidecars
+// like istio-proxy are never selected.
+type ContainerSelector struct {
+	// Name of the container
+	// +optional
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+	// Regex to match container names
+	// +optional
+	NameRegex string `json:"nameRegex,omitempty" yaml:"nameRegex,omitempty"`
+	// Regex to match container images
+	// +optional
+	ImageRegex string `json:"imageRegex,omitempty" yaml:"imageRegex,omitempty"`
+	// Select all application containers, when no other criteria are specified
+	// +optional
+	AllApplicationContainers *bool `json:"allApplicationContainers,omitempty" yaml:"allApplicationContainers,omitempty"`
 }
 
 type SplunkConfig struct {
@@ -123,8 +179,56 @@ type InstrumentationSpec struct {
 	Priority int `json:"priority" yaml:"priority"`
 
 	InjectionRuleSet []InjectionRule `json:"injectionRuleSet,omitempty" yaml:"injectionRuleSet,omitempty"`
+
+	// FailurePolicy defines what happens to a matched pod when injection cannot be completed,
+	// Ignore admits the pod uninstrumented, Fail denies its creation
+	// +optional
+	// +kubebuilder:validation:Enum=Ignore;Fail
+	FailurePolicy FailurePolicy `json:"failurePolicy,omitempty" yaml:"failurePolicy,omitempty"`
+
+	// Suspend turns the rule off without deleting it, pods are matched against further rules
+	// +optional
+	Suspend *bool `json:"suspend,omitempty" yaml:"suspend,omitempty"`
+
+	// ActiveFrom is the time the rule applies from
+	// +optional
+	ActiveFrom *metav1.Time `json:"activeFrom,omitempty" yaml:"activeFrom,omitempty"`
+
+	// ActiveUntil is the time the rule applies until
+	// +optional
+	ActiveUntil *metav1.Time `json:"activeUntil,omitempty" yaml:"activeUntil,omitempty"`
+
+	// Rollout limits the rule to a share of the matching pods, the rest is matched against further rules
+	// +optional
+	Rollout *Rollout `json:"rollout,omitempty" yaml:"rollout,omitempty"`
+}
+
+// Rollout selects a share of pods by a stable hash of the workload owning the pod and pod identity,
+// so that the same pods are selected every time. Pods with generated names, e.g. of Deployments,
+// DaemonSets or Jobs, have no name yet at admission, and neither the ReplicaSet hash with a per-pod
+// suffix nor an ordinal is available, so such pods are selected by the workload as a whole and
+// the percentage applies to workloads. StatefulSet pods are named by ordinal and selected one by one.
+type Rollout struct {
+	// Percentage of pods the rule applies to, of workloads for pods with generated names
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=100
+	Percentage int `json:"percentage" yaml:"percentage"`
 }
 
+type (
+	// FailurePolicy defines how failures of injection are handled
+	// +kubebuilder:validation:Enum=Ignore;Fail
+	FailurePolicy string
+)
+
+const (
+	// FailurePolicyIgnore admits the pod without instrumentation. This is the default.
+	FailurePolicyIgnore FailurePolicy = "Ignore"
+
+	// FailurePolicyFail denies the pod creation.
+	FailurePolicyFail FailurePolicy = "Fail"
+)
+
 type InjectionTemplate struct {
 	Name           string         `json:"name,omitempty" yaml:"name,omitempty" `
 	InjectionRules *InjectionRule `json:"injectionRules,omitempty" yaml:"injectionRules,omitempty" `
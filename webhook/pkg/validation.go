@@ -0,0 +1,346 @@
+/*
+Copyright (c) 2019 Cisco Systems, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"text/template"
+	"time"
+	"v1alpha1"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	metav1validation "k8s.io/apimachinery/pkg/apis/meta/v1/validation"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// supportedTechnologies lists, per provider, the technologies the instrumentor knows how to inject
+var supportedTechnologies = map[string][]string{
+	"appd":   {"java", "dotnetcore", "nodejs", "apache"},
+	"otel":   {"java", "dotnetcore", "nodejs", "apache", "nginx"},
+	"splunk": {"java"},
+}
+
+// validateInstrumentationSpec checks a single instrumentation rule. Errors make the rule unusable and must be fixed,
+// warnings point at settings which are accepted but most likely do not do what the author intended.
+// namespace is the namespace of an Instrumentation CR, or empty for cluster-wide and config map rules.
+func validateInstrumentationSpec(spec *v1alpha1.InstrumentationSpec, namespace string, fldPath *field.Path) (field.ErrorList, []string) {
+	errs := field.ErrorList{}
+	warnings := []string{}
+
+	if spec.MatchRules == nil {
+		errs = append(errs, field.Required(fldPath.Child("matchRules"), "match rules must be specified"))
+	} else {
+		matchErrs, matchWarnings := validateMatchRule(spec.MatchRules, namespace, fldPath.Child("matchRules"))
+		errs = append(errs, matchErrs...)
+		warnings = append(warnings, matchWarnings...)
+	}
+
+	switch spec.FailurePolicy {
+	case "", v1alpha1.FailurePolicyIgnore, v1alpha1.FailurePolicyFail:
+	default:
+		errs = append(errs, field.NotSupported(fldPath.Child("failurePolicy"), spec.FailurePolicy,
+			[]string{string(v1alpha1.FailurePolicyIgnore), string(v1alpha1.FailurePolicyFail)}))
+	}
+
+	if spec.ActiveFrom != nil && spec.ActiveUntil != nil && !spec.ActiveFrom.Before(spec.ActiveUntil) {
+		errs = append(errs, field.Invalid(fldPath.Child("activeUntil"), spec.ActiveUntil, "must be after activeFrom"))
+	}
+	if spec.Rollout != nil && (spec.Rollout.Percentage < 0 || spec.Rollout.Percentage > 100) {
+		errs = append(errs, field.Invalid(fldPath.Child("rollout", "percentage"), spec.Rollout.Percentage, "must be between 0 and 100"))
+	}
+
+	if spec.InjectionRules == nil && len(spec.InjectionRuleSet) == 0 {
+		errs = append(errs, field.Required(fldPath.Child("injectionRules"), "either injectionRules or injectionRuleSet must be specified"))
+	}
+	if spec.InjectionRules != nil && len(spec.InjectionRuleSet) > 0 {
+		warnings = append(warnings, fmt.Sprintf("%s: ignored, %s takes precedence",
+			fldPath.Child("injectionRules"), fldPath.Child("injectionRuleSet")))
+	}
+	if spec.InjectionRules != nil {
+		injErrs, injWarnings := validateInjectionRule(spec.InjectionRules, namespace, fldPath.Child("injectionRules"))
+		errs = append(errs, injErrs...)
+		warnings = append(warnings, injWarnings...)
+	}
+	for idx := range spec.InjectionRuleSet {
+		injErrs, injWarnings := validateInjectionRule(&spec.InjectionRuleSet[idx], namespace, fldPath.Child("injectionRuleSet").Index(idx))
+		errs = append(errs, injErrs...)
+		warnings = append(warnings, injWarnings...)
+	}
+
+	return errs, warnings
+}
+
+func validateMatchRule(matchRules *v1alpha1.MatchRule, namespace string, fldPath *field.Path) (field.ErrorList, []string) {
+	errs := field.ErrorList{}
+	warnings := []string{}
+
+	if matchRules.NamespaceRegex != "" {
+		if namespace != "" {
+			warnings = append(warnings, fmt.Sprintf("%s: ignored, Instrumentation only applies to namespace %s",
+				fldPath.Child("namespaceRegex"), namespace))
+		}
+		if _, err := regexp.Compile(matchRules.NamespaceRegex); err != nil {
+			errs = append(errs, field.Invalid(fldPath.Child("namespaceRegex"), matchRules.NamespaceRegex, err.Error()))
+		}
+	}
+	if matchRules.PodNameRegex != "" {
+		if _, err := regexp.Compile(matchRules.PodNameRegex); err != nil {
+			errs = append(errs, field.Invalid(fldPath.Child("podNameRegex"), matchRules.PodNameRegex, err.Error()))
+		}
+	}
+	if matchRules.Annotations != nil {
+		for idx, annotRule := range *matchRules.Annotations {
+			for annot, regex := range annotRule {
+				if _, err := regexp.Compile(regex); err != nil {
+					errs = append(errs, field.Invalid(fldPath.Child("annotations").Index(idx).Key(annot), regex, err.Error()))
+				}
+			}
+		}
+	}
+	if matchRules.Labels != nil {
+		for idx, labelRule := range *matchRules.Labels {
+			for label, regex := range labelRule {
+				if _, err := regexp.Compile(regex); err != nil {
+					errs = append(errs, field.Invalid(fldPath.Child("labels").Index(idx).Key(label), regex, err.Error()))
+				}
+			}
+		}
+	}
+	if len(matchRules.MatchLabels) > 0 || len(matchRules.MatchExpressions) > 0 {
+		// matchLabels and matchExpressions are validated as parts of one label selector
+		errs = append(errs, metav1validation.ValidateLabelSelector(&metav1.LabelSelector{
+			MatchLabels:      matchRules.MatchLabels,
+			MatchExpressions: matchRules.MatchExpressions,
+		}, metav1validation.LabelSelectorValidationOptions{}, fldPath)...)
+	}
+	if matchRules.ImageRegex != "" {
+		if _, err := regexp.Compile(matchRules.ImageRegex); err != nil {
+			errs = append(errs, field.Invalid(fldPath.Child("imageRegex"), matchRules.ImageRegex, err.Error()))
+		}
+	}
+	if matchRules.OwnerKind != "" {
+		if _, err := regexp.Compile("^(?:" + matchRules.OwnerKind + ")$"); err != nil {
+			errs = append(errs, field.Invalid(fldPath.Child("ownerKind"), matchRules.OwnerKind, err.Error()))
+		}
+	}
+	if matchRules.OwnerNameRegex != "" {
+		if _, err := regexp.Compile(matchRules.OwnerNameRegex); err != nil {
+			errs = append(errs, field.Invalid(fldPath.Child("ownerNameRegex"), matchRules.OwnerNameRegex, err.Error()))
+		}
+	}
+	if matchRules.Expression != "" {
+		if _, _, err := compileMatchExpression(matchRules.Expression); err != nil {
+			errs = append(errs, field.Invalid(fldPath.Child("expression"), matchRules.Expression, err.Error()))
+		}
+	}
+	if matchRules.NamespaceSelector != nil {
+		errs = append(errs, metav1validation.ValidateLabelSelector(matchRules.NamespaceSelector,
+			metav1validation.LabelSelectorValidationOptions{}, fldPath.Child("namespaceSelector"))...)
+	}
+	if matchRules.NamespaceAnnotations != nil {
+		for idx, annotRule := range *matchRules.NamespaceAnnotations {
+			for annot, regex := range annotRule {
+				if _, err := regexp.Compile(regex); err != nil {
+					errs = append(errs, field.Invalid(fldPath.Child("namespaceAnnotations").Index(idx).Key(annot), regex, err.Error()))
+				}
+			}
+		}
+	}
+
+	return errs, warnings
+}
+
+func validateInjectionRule(injRules *v1alpha1.InjectionRule, namespace string, fldPath *field.Path) (field.ErrorList, []string) {
+	errs := field.ErrorList{}
+	warnings := []string{}
+
+	doNotInstrument := injRules.DoNotInstrument != nil && *injRules.DoNotInstrument
+
+	technology, provider := getTechnologyAndProvider(injRules.Technology)
+	if injRules.Technology == "" {
+		if !doNotInstrument {
+			errs = append(errs, field.Required(fldPath.Child("technology"), "technology to instrument must be specified"))
+		}
+	} else if technologies, found := supportedTechnologies[provider]; !found || !slices.Contains(technologies, technology) {
+		errs = append(errs, field.NotSupported(fldPath.Child("technology"), injRules.Technology, supportedTechnologyNames()))
+	} else if technology == "apache" && provider == "appd" {
+		warnings = append(warnings, fmt.Sprintf("%s: apache/appd does not inject an agent, consider apache/otel", fldPath.Child("technology")))
+	}
+
+	if injRules.Image == "" && !doNotInstrument {
+		errs = append(errs, field.Required(fldPath.Child("image"), "agent image must be specified"))
+	}
+
+	if injRules.OpenTelemetryCollector != "" {
+		if !otelCollectorDefined(namespace, injRules.OpenTelemetryCollector) {
+			if namespace != "" {
+				errs = append(errs, field.NotFound(fldPath.Child("openTelemetryCollector"), injRules.OpenTelemetryCollector))
+			} else {
+				// cluster-wide rules resolve the collector in the namespace of the pod, so it may still exist there
+				warnings = append(warnings, fmt.Sprintf("%s: collector %s is not defined by the instrumentor, it must exist in every matched namespace",
+					fldPath.Child("openTelemetryCollector"), injRules.OpenTelemetryCollector))
+			}
+		}
+	}
+
+	warnings = append(warnings, validateNameSource(fldPath, "applicationName", injRules.ApplicationNameSource,
+		injRules.ApplicationName, injRules.ApplicationNameLabel, injRules.ApplicationNameAnnotation)...)
+	warnings = append(warnings, validateNameSource(fldPath, "tierName", injRules.TierNameSource,
+		injRules.TierName, injRules.TierNameLabel, injRules.TierNameAnnotation)...)
+	if injRules.ApplicationNameSource == "expression" {
+		if _, err := template.New("expr").Parse(injRules.ApplicationNameExpression); err != nil {
+			errs = append(errs, field.Invalid(fldPath.Child("applicationNameExpression"), injRules.ApplicationNameExpression, err.Error()))
+		}
+	}
+
+	if injRules.ResourceReservation != nil {
+		if injRules.ResourceReservation.CPU != "" {
+			if _, err := resource.ParseQuantity(injRules.ResourceReservation.CPU); err != nil {
+				errs = append(errs, field.Invalid(fldPath.Child("resourceReservation", "cpu"), injRules.ResourceReservation.CPU, err.Error()))
+			}
+		}
+		if injRules.ResourceReservation.Memory != "" {
+			if _, err := resource.ParseQuantity(injRules.ResourceReservation.Memory); err != nil {
+				errs = append(errs, field.Invalid(fldPath.Child("resourceReservation", "memory"), injRules.ResourceReservation.Memory, err.Error()))
+			}
+		}
+	}
+
+	if selector := injRules.ContainerSelector; selector != nil {
+		if selector.NameRegex != "" {
+			if _, err := regexp.Compile(selector.NameRegex); err != nil {
+				errs = append(errs, field.Invalid(fldPath.Child("containerSelector", "nameRegex"), selector.NameRegex, err.Error()))
+			}
+		}
+		if selector.ImageRegex != "" {
+			if _, err := regexp.Compile(selector.ImageRegex); err != nil {
+				errs = append(errs, field.Invalid(fldPath.Child("containerSelector", "imageRegex"), selector.ImageRegex, err.Error()))
+			}
+		}
+		if selector.Name != "" && !isApplicationContainer(selector.Name) {
+			warnings = append(warnings, fmt.Sprintf("%s: container %s is a sidecar, not an application container",
+				fldPath.Child("containerSelector", "name"), selector.Name))
+		}
+		if slices.Contains(SINGLE_CONTAINER_TECHNOLOGIES, technology) && selector.Name == "" {
+			if selector.AllApplicationContainers != nil && *selector.AllApplicationContainers {
+				errs = append(errs, field.Invalid(fldPath.Child("containerSelector", "allApplicationContainers"), true,
+					fmt.Sprintf("%s can be injected into a single container only", technology)))
+			} else if selector.NameRegex != "" || selector.ImageRegex != "" {
+				warnings = append(warnings, fmt.Sprintf("%s: %s can be injected into a single container only, injection fails when the regex selects more",
+					fldPath.Child("containerSelector"), technology))
+			}
+		}
+	}
+
+	if injRules.SplunkConfig != nil && provider != "splunk" {
+		warnings = append(warnings, fmt.Sprintf("%s: ignored for provider %s", fldPath.Child("splunkConfig"), provider))
+	}
+
+	return errs, warnings
+}
+
+// COLLECTOR_LOOKUP_TIMEOUT bounds reading a collector from the API server during validation. Like
+// OWNER_LOOKUP_TIMEOUT, it must stay well within the webhook timeoutSeconds
+const COLLECTOR_LOOKUP_TIMEOUT = 500 * time.Millisecond
+
+// otelCollectorDefined checks the collector registry and, for namespaced collectors, falls back to the API server.
+// The registry is only updated from watch events, so a collector created together with the rule may not be there yet.
+// Only a NotFound answer counts as undefined, a slow or failing API server must not reject valid rules.
+func otelCollectorDefined(namespace string, name string) bool {
+	if _, _, err := getCollectorConfigsByName(namespace, name); err == nil {
+		return true
+	}
+	if namespace == "" || client == nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), COLLECTOR_LOOKUP_TIMEOUT)
+	defer cancel()
+	_, err := client.Resource(schema.GroupVersionResource(otelCollResource)).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	return !apierrors.IsNotFound(err)
+}
+
+// validateNameSource warns when the source of application or tier name refers to a field which is left empty
+func validateNameSource(fldPath *field.Path, prefix string, source string, manual string, label string, annotation string) []string {
+	warnings := []string{}
+
+	missing := ""
+	switch source {
+	case "manual":
+		if manual == "" {
+			missing = prefix
+		}
+	case "label", "namespaceLabel":
+		if label == "" {
+			missing = prefix + "Label"
+		}
+	case "annotation", "namespaceAnnotation":
+		if annotation == "" {
+			missing = prefix + "Annotation"
+		}
+	}
+	if missing != "" {
+		warnings = append(warnings, fmt.Sprintf("%s: %s is %s but %s is empty, %s will be blank",
+			fldPath.Child(prefix+"Source"), prefix+"Source", source, fldPath.Child(missing), prefix))
+	}
+
+	return warnings
+}
+
+func supportedTechnologyNames() []string {
+	names := []string{}
+	for provider, technologies := range supportedTechnologies {
+		for _, technology := range technologies {
+			names = append(names, technology+"/"+provider)
+			if provider == "appd" {
+				names = append(names, technology)
+			}
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// validateOtelCollectorSpec checks an OpenTelemetryCollector before it is registered
+func validateOtelCollectorSpec(spec *v1alpha1.OpenTelemetryCollectorSpec, fldPath *field.Path) (field.ErrorList, []string) {
+	errs := field.ErrorList{}
+	warnings := []string{}
+
+	switch spec.Mode {
+	case v1alpha1.ModeExternal:
+		if spec.OtlpEndpoint == "" {
+			errs = append(errs, field.Required(fldPath.Child("otlpEndpoint"), "external collector requires an endpoint"))
+		}
+	case "", v1alpha1.ModeDeployment, v1alpha1.ModeSidecar:
+		if spec.Config == "" {
+			errs = append(errs, field.Required(fldPath.Child("config"), "collector configuration must be specified"))
+		}
+		if spec.OtlpEndpoint != "" {
+			warnings = append(warnings, fmt.Sprintf("%s: ignored, only used in mode %s", fldPath.Child("otlpEndpoint"), v1alpha1.ModeExternal))
+		}
+	default:
+		errs = append(errs, field.NotSupported(fldPath.Child("mode"), spec.Mode,
+			[]string{string(v1alpha1.ModeDeployment), string(v1alpha1.ModeSidecar), string(v1alpha1.ModeExternal)}))
+	}
+
+	return errs, warnings
+}